@@ -0,0 +1,259 @@
+package cmd
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gnanderson/rbh/firewall"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// supported firewall backends
+const (
+	backendFirewalld = "firewalld"
+	backendNftables  = "nftables"
+	backendIptables  = "iptables"
+)
+
+// supported disconnectors
+const (
+	disconnectSS        = "ss"
+	disconnectNetlink   = "netlink"
+	disconnectTCPKill   = "tcpkill"
+	disconnectConntrack = "conntrack"
+)
+
+var (
+	backend, zone, iface            string
+	action, rejectWith, rejectWith6 string
+	logLimit, disconnect            string
+	namespace, containerSocket      string
+	ipset, permanent, portOnly      bool
+	conntrack                       bool
+	tcpkillAggression               int
+	tcpkillTimeout                  time.Duration
+	disconnectWorkers               int
+	disconnectRetries               int
+	disconnectTimeout               time.Duration
+	tarpitPort, peerPort            int
+)
+
+// actionFlags adds the flags configuring the ban action to a command
+func actionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&action, "action", firewall.ActionDrop, "Action taken on traffic from banned peers, one of 'drop', 'reject' or 'tarpit'.")
+	cmd.Flags().StringVar(&rejectWith, "reject-with", "", "ICMP type banned IPv4 peers are rejected with e.g. 'icmp-host-prohibited' (reject action only).")
+	cmd.Flags().StringVar(&rejectWith6, "reject-with6", "", "ICMPv6 type banned IPv6 peers are rejected with e.g. 'icmp6-adm-prohibited' (reject action only).")
+	cmd.Flags().IntVar(&tarpitPort, "tarpit-port", 0, "Local port the peer port of banned peers is forwarded to (tarpit action only).")
+	cmd.Flags().IntVar(&peerPort, "peer-port", firewall.DefaultPeerPort, "The rippled peer protocol port.")
+	cmd.Flags().StringVar(&logLimit, "log-limit", "", "Rate traffic from banned peers is logged at e.g. '10/m', every packet is logged if unset.")
+	cmd.Flags().BoolVar(&portOnly, "port-only", false, "Only ban traffic to or from the peer port, and only close peer port sockets, so banned peers can still reach RPC or websocket ports.")
+}
+
+// zoneFlags adds the flags choosing where firewalld bans are applied
+func zoneFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&zone, "zone", "", "firewalld zone bans are added to, the default zone if unset (firewalld backend only).")
+	cmd.Flags().StringVar(&iface, "interface", "", "Add bans to the firewalld zone of the interface peers connect on (firewalld backend only).")
+}
+
+// disconnectFlags adds the flags choosing how the sockets of banned peers are
+// closed
+func disconnectFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&disconnect, "disconnect", disconnectSS, "How the sockets of banned peers are closed, one of 'ss', 'netlink' (SOCK_DESTROY without running ss), 'tcpkill' or 'conntrack' (only delete their conntrack entries). A comma separated list is tried in order until the peer's sockets are gone, e.g. 'netlink,ss,conntrack,tcpkill'.")
+	cmd.Flags().StringVar(&namespace, "netns", "", "Close sockets inside the network namespace of rippled, given as a PID, a netns path or a docker/podman container name, e.g. with --disconnect netlink where the image has no ss.")
+	cmd.Flags().StringVar(&containerSocket, "container-socket", "", "Docker or Podman API socket --netns container names are resolved through, by default the docker then the podman socket.")
+	cmd.Flags().IntVar(&disconnectWorkers, "disconnect-workers", firewall.DefaultDisconnectWorkers, "Number of banned peers disconnected at once in the background, 0 disconnects each peer before banning the next.")
+	cmd.Flags().DurationVar(&disconnectTimeout, "disconnect-timeout", firewall.DefaultDisconnectTimeout, "How long each attempt to disconnect a banned peer is given (background disconnects only).")
+	cmd.Flags().IntVar(&disconnectRetries, "disconnect-retries", firewall.DefaultDisconnectRetries, "How many times a failed disconnect is retried (background disconnects only).")
+	cmd.Flags().BoolVar(&conntrack, "conntrack", false, "Also delete the conntrack entries of banned peers once their sockets are closed, e.g. when rippled is behind NAT or in docker.")
+	cmd.Flags().StringVarP(&container, "docker", "d", "", "Optional name of a docker container to exec the socket close on.")
+	cmd.Flags().BoolVarP(&tcpkill, "tcpkill", "k", false, "Use `tcpkill` instead of `ss -K` to close the banned peers socket, the same as --disconnect tcpkill.")
+	cmd.Flags().IntVar(&tcpkillAggression, "tcpkill-aggression", 3, "How aggressively tcpkill resets the banned peers connections, 1-9 (tcpkill only).")
+	cmd.Flags().DurationVar(&tcpkillTimeout, "tcpkill-timeout", firewall.DefaultTCPKillTimeout, "How long tcpkill is left running for each banned peer (tcpkill only).")
+}
+
+// newDisconnector returns the Disconnector chosen by the disconnect flags, if
+// more than one is named they are tried in order until the sockets are closed
+// by the ChainDisconnector also returned, otherwise it is nil
+func newDisconnector() (firewall.Disconnector, *firewall.ChainDisconnector, error) {
+	var names []string
+	for _, value := range viper.GetStringSlice("disconnect") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	if viper.GetBool("tcpkill") {
+		names = []string{disconnectTCPKill}
+	}
+	if len(names) == 0 {
+		names = []string{disconnectSS}
+	}
+
+	strategies := make([]firewall.Strategy, 0, len(names))
+	for _, name := range names {
+		d, err := namedDisconnector(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		strategies = append(strategies, firewall.Strategy{
+			Name:         name,
+			Disconnector: d,
+			// the chain cannot count sockets in a docker container, or the
+			// conntrack flows it deletes
+			Unverifiable: name == disconnectConntrack || viper.GetString("docker") != "",
+		})
+	}
+
+	d := strategies[0].Disconnector
+	var chain *firewall.ChainDisconnector
+	if len(strategies) > 1 {
+		chain = firewall.NewChainDisconnector(viper.GetInt("peer-port"), strategies...)
+		d = chain
+	}
+
+	if ns := viper.GetString("netns"); ns != "" {
+		if viper.GetString("docker") != "" {
+			return nil, nil, fmt.Errorf("--netns and --docker cannot be used together")
+		}
+		nd := firewall.NewNamespaceDisconnector(ns, d)
+		nd.Socket = viper.GetString("container-socket")
+		d = nd
+	}
+
+	// conntrack entries for NATed flows are in rbh's namespace
+	if _, ok := d.(*firewall.ConntrackDisconnector); viper.GetBool("conntrack") && !ok {
+		d = conntrackDisconnector(d)
+	}
+
+	if workers := viper.GetInt("disconnect-workers"); workers > 0 {
+		pool := firewall.NewDisconnectPool(d)
+		pool.Workers = workers
+		pool.Timeout = viper.GetDuration("disconnect-timeout")
+		pool.Retries = viper.GetInt("disconnect-retries")
+		d = pool
+	}
+
+	return d, chain, nil
+}
+
+// namedDisconnector returns a single Disconnector configured by the flags
+func namedDisconnector(name string) (firewall.Disconnector, error) {
+	switch name {
+	case disconnectSS:
+		return scopeDisconnector(firewall.NewSSDisconnector(viper.GetString("docker"))), nil
+	case disconnectNetlink:
+		if viper.GetString("docker") != "" {
+			return nil, fmt.Errorf("--docker is not supported by the netlink disconnector")
+		}
+		return firewall.NewNetlinkDisconnector(viper.GetInt("peer-port")), nil
+	case disconnectTCPKill:
+		tcp := firewall.NewTCPKIllDisconnector(viper.GetString("docker"))
+		tcp.Aggression = viper.GetInt("tcpkill-aggression")
+		tcp.Timeout = viper.GetDuration("tcpkill-timeout")
+		tcp.Port = viper.GetInt("peer-port")
+		if tcp.Aggression < 1 || tcp.Aggression > 9 {
+			return nil, fmt.Errorf("invalid --tcpkill-aggression '%d', levels are 1-9", tcp.Aggression)
+		}
+		return scopeDisconnector(tcp), nil
+	case disconnectConntrack:
+		// no sockets are closed, only the conntrack entries deleted
+		return conntrackDisconnector(nil), nil
+	}
+
+	return nil, fmt.Errorf("unknown disconnector '%s'", name)
+}
+
+// conntrackDisconnector deletes the conntrack entries after the sockets are
+// closed by the Disconnector, which may be nil
+func conntrackDisconnector(d firewall.Disconnector) *firewall.ConntrackDisconnector {
+	cd := firewall.NewConntrackDisconnector(d)
+	if viper.GetBool("port-only") {
+		cd.Port = viper.GetInt("peer-port")
+	}
+
+	return cd
+}
+
+// newBackend returns the named firewall backend ready for use
+func newBackend(name string) (firewall.Backend, error) {
+	action, err := firewall.NewAction(
+		viper.GetString("action"),
+		viper.GetString("reject-with"),
+		viper.GetString("reject-with6"),
+		viper.GetInt("tarpit-port"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if action, err = action.WithPort(viper.GetInt("peer-port"), viper.GetBool("port-only")); err != nil {
+		return nil, err
+	}
+	if action, err = action.WithLogLimit(viper.GetString("log-limit")); err != nil {
+		return nil, err
+	}
+
+	if name != backendFirewalld && (viper.GetString("zone") != "" || viper.GetString("interface") != "") {
+		return nil, fmt.Errorf("--zone and --interface are only supported by the firewalld backend")
+	}
+	if name != backendFirewalld && viper.GetBool("permanent") {
+		return nil, fmt.Errorf("--permanent is only supported by the firewalld backend")
+	}
+
+	switch name {
+	case backendFirewalld:
+		fwd, err := firewall.NewFirewalldBackend(viper.GetString("zone"), viper.GetString("interface"), action)
+		if err != nil {
+			return nil, err
+		}
+		fwd.IPSet = viper.GetBool("ipset")
+		fwd.Permanent = viper.GetBool("permanent")
+		return fwd, nil
+	case backendNftables:
+		return firewall.NewNftablesBackend(action)
+	case backendIptables:
+		return firewall.NewIptablesBackend(action)
+	}
+
+	return nil, fmt.Errorf("unknown firewall backend '%s'", name)
+}
+
+// scopeDisconnector limits the sockets closed to those on the peer port when
+// bans are port scoped
+func scopeDisconnector(d firewall.Disconnector) firewall.Disconnector {
+	if !viper.GetBool("port-only") {
+		return d
+	}
+
+	switch d := d.(type) {
+	case *firewall.SSDisconnector:
+		scoped := *d
+		scoped.Port = viper.GetInt("peer-port")
+		return &scoped
+	case *firewall.TCPKillDisconnector:
+		scoped := *d
+		scoped.Port = viper.GetInt("peer-port")
+		scoped.PortOnly = true
+		return &scoped
+	}
+
+	return d
+}
@@ -28,11 +28,17 @@ import (
 
 // banCmd represents the ban command
 var banCmd = &cobra.Command{
-	Use:   "ban",
-	Short: "ban one or more IP addresses",
+	Use:   "ban <ip|cidr>...",
+	Short: "ban one or more IP addresses or networks",
 	Args:  cobra.MinimumNArgs(1),
-	Long:  `Ban one of more IP address provided as a space separated list of args`,
+	Long: `Ban one of more IP addresses or CIDR networks provided as a space separated
+list of args, e.g.
+
+  rbh ban 192.0.2.10 2001:db8:1:2::/64
+
+Connected peers within a banned network are disconnected.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		bindFlags(cmd, "backend", "action", "reject-with", "reject-with6", "tarpit-port", "zone", "interface", "peer-port", "port-only", "log-limit", "disconnect", "docker", "tcpkill", "tcpkill-aggression", "tcpkill-timeout", "conntrack", "netns", "container-socket", "disconnect-workers", "disconnect-timeout", "disconnect-retries")
 		ban(args)
 	},
 }
@@ -40,22 +46,30 @@ var banCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(banCmd)
 	banCmd.Flags().IntVarP(&banLength, "banlength", "b", 1440, "the duration of the ban (in minutes)")
-	banCmd.Flags().StringVarP(&container, "docker", "d", "", "Optional name of a docker container to exec the socket close on.")
-	banCmd.Flags().BoolVarP(&tcpkill, "tcpkill", "k", false, "Use `tcpkill` instead of `ss -K` to close the banned peers socket.")
+	banCmd.Flags().StringVar(&backend, "backend", backendFirewalld, "Firewall backend used to enforce bans, one of 'firewalld', 'nftables' or 'iptables'.")
+	actionFlags(banCmd)
+	zoneFlags(banCmd)
+	disconnectFlags(banCmd)
 }
 
 func ban(args []string) {
 	ips := make([]net.IP, 0)
-	for _, ip := range args {
-		netIP := net.ParseIP(ip)
+	networks := make([]*net.IPNet, 0)
+	for _, arg := range args {
+		if _, network, err := net.ParseCIDR(arg); err == nil {
+			networks = append(networks, network)
+			continue
+		}
+
+		netIP := net.ParseIP(arg)
 		if netIP == nil {
-			log.Printf("invalid IP %s", ip)
+			log.Printf("invalid IP %s", arg)
 			continue
 		}
 		ips = append(ips, netIP)
 	}
 
-	if len(ips) == 0 {
+	if len(ips) == 0 && len(networks) == 0 {
 		log.Fatal("no valid ips provided")
 	}
 
@@ -65,7 +79,8 @@ func ban(args []string) {
 	cmd.AdminUser = viper.GetString("user")
 	cmd.AdminPassword = viper.GetString("passwd")
 
-	if err := firewall.Connect(); err != nil {
+	fwBackend, err := newBackend(viper.GetString("backend"))
+	if err != nil {
 		log.Fatal("firewall ban:", err)
 	}
 
@@ -79,17 +94,32 @@ func ban(args []string) {
 		log.Fatal(err)
 	}
 	fw := firewall.NewFirewall(banLength, viper.GetStringSlice("whitelist")...)
-	if container != "" {
-		fw.Disconnector = firewall.NewSSDisconnector(viper.GetString("docker"))
+	// nothing would be left running to remove the ipset entry or permanent
+	// rule when the ban expires, so use timed rich rules
+	if fwd, ok := fwBackend.(*firewall.FirewalldBackend); ok {
+		fwd.IPSet = false
+		fwd.Permanent = false
 	}
-	if tcpkill {
-		fw.Disconnector = firewall.NewTCPKIllDisconnector(viper.GetString("docker"))
+	fw.Backend = fwBackend
+	defer fw.Close()
+	disconnector, _, err := newDisconnector()
+	if err != nil {
+		log.Fatal("firewall ban:", err)
+	}
+	fw.Disconnector = disconnector
+
+	for _, network := range networks {
+		if err := fw.BanNetwork(network, pl.Peers()...); err != nil {
+			log.Println("firewall ban:", err)
+			continue
+		}
+		log.Println("network banned:", network.String())
 	}
 
 	for _, peer := range pl.Peers() {
 		for _, ip := range ips {
 			if ip.Equal(peer.IP()) {
-				fw.BanPeer(peer)
+				fw.BanPeerFor(peer, firewall.ReasonManual)
 				log.Println("peer banned:", peer.IP().String(), peer.PublicKey)
 			}
 		}
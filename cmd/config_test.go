@@ -4,7 +4,9 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/gnanderson/rbh/firewall"
 	"github.com/spf13/viper"
 )
 
@@ -98,3 +100,30 @@ func TestWhitelistFromEnv(t *testing.T) {
 		}
 	}
 }
+
+func TestPolicyFromConfig(t *testing.T) {
+	cfgFile = "../examples/.rbh.yaml"
+	initConfig()
+
+	policy, err := newPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Rules) != 4 {
+		t.Fatalf("unexpected number of rules '%d'", len(policy.Rules))
+	}
+
+	rule := policy.Rules[0]
+	if rule.Name != "old-version" || rule.Action != firewall.RuleBan || rule.BanLength != 168*time.Hour {
+		t.Errorf("unexpected rule %+v", rule)
+	}
+	if rule := policy.Rules[1]; len(rule.Sanity) != 2 || rule.UptimeOver != 30*time.Minute || rule.Reason != "sanity" {
+		t.Errorf("unexpected rule %+v", rule)
+	}
+	if rule := policy.Rules[2]; rule.LatencyOver != 800 || rule.Action != firewall.RuleObserve {
+		t.Errorf("unexpected rule %+v", rule)
+	}
+	if rule := policy.Rules[3]; rule.Expr != "history.polls >= 3 && history.unstable >= 2 && !peer.cluster" || rule.Action != firewall.RuleBan {
+		t.Errorf("unexpected rule %+v", rule)
+	}
+}
@@ -0,0 +1,169 @@
+package cmd
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gnanderson/rbh/firewall"
+)
+
+// The control socket lets other rbh commands talk to a running `rbh run`. The
+// protocol is a line per request, each answered by a line starting with "ok"
+// or "error", e.g.
+//
+//	> unban 192.0.2.10
+//	< ok 192.0.2.10/32
+const (
+	defaultControlSocket = "/run/rbh.sock"
+	controlUnban         = "unban"
+	controlOK            = "ok"
+	controlError         = "error"
+)
+
+var controlSocket string
+
+// serveControl listens on the control socket until the context is done
+func serveControl(ctx context.Context, path string, fw *firewall.Firewall) error {
+	// a socket left behind by an rbh that didn't exit cleanly
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("control: %s is in use, is rbh already running?", path)
+	}
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("control: %v", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("control: %v", err)
+	}
+	log.Println("control: listening on", path)
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println("control:", err)
+				}
+				return
+			}
+			go handleControl(conn, fw)
+		}
+	}()
+
+	return nil
+}
+
+func handleControl(conn net.Conn, fw *firewall.Firewall) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var reply string
+		switch {
+		case fields[0] == controlUnban && len(fields) == 2:
+			log.Println("control: unban requested for", fields[1])
+			bans, err := fw.UnbanPeer(fields[1])
+			reply = unbanReply(bans, err)
+		default:
+			reply = fmt.Sprintf("%s unknown request '%s'", controlError, scanner.Text())
+		}
+
+		if _, err := fmt.Fprintln(conn, reply); err != nil {
+			log.Println("control:", err)
+			return
+		}
+	}
+}
+
+func unbanReply(bans []*firewall.Ban, err error) string {
+	if err != nil {
+		return fmt.Sprintf("%s %v", controlError, err)
+	}
+
+	lifted := make([]string, 0, len(bans))
+	for _, ban := range bans {
+		lifted = append(lifted, ban.CIDR())
+	}
+
+	return strings.TrimSpace(fmt.Sprintf("%s %s", controlOK, strings.Join(lifted, " ")))
+}
+
+// controlClient is a connection to the control socket of a running rbh
+type controlClient struct {
+	conn    net.Conn
+	replies *bufio.Scanner
+}
+
+// dialControl connects to a running rbh, an error means there isn't one
+func dialControl(path string) (*controlClient, error) {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	return &controlClient{conn: conn, replies: bufio.NewScanner(conn)}, nil
+}
+
+// request sends a request returning the reply without the "ok" status, or
+// the reply as an error
+func (cc *controlClient) request(args ...string) (string, error) {
+	cc.conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err := fmt.Fprintln(cc.conn, strings.Join(args, " ")); err != nil {
+		return "", err
+	}
+
+	if !cc.replies.Scan() {
+		if err := cc.replies.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("control: connection closed")
+	}
+
+	reply := cc.replies.Text()
+	if strings.HasPrefix(reply, controlOK) {
+		return strings.TrimSpace(strings.TrimPrefix(reply, controlOK)), nil
+	}
+
+	return "", fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(reply, controlError)))
+}
+
+func (cc *controlClient) Close() error {
+	return cc.conn.Close()
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/gnanderson/rbh/firewall"
+	"github.com/gnanderson/xrpl"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+type nopDisconnector struct{}
+
+func (nopDisconnector) Disconnect(*xrpl.Peer) error { return nil }
+
+func TestControlUnban(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mb := firewall.NewMemoryBackend("drop")
+	fw := firewall.NewFirewall(10)
+	fw.Backend = mb
+	fw.Disconnector = nopDisconnector{}
+	fw.BanPeer(&xrpl.Peer{Address: "192.0.2.10:51235", PublicKey: "x"})
+
+	path := filepath.Join(t.TempDir(), "rbh.sock")
+	if err := serveControl(ctx, path, fw); err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := dialControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	lifted, err := cc.request(controlUnban, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifted != "192.0.2.10/32" {
+		t.Fatalf("unexpected reply '%s'", lifted)
+	}
+	if len(mb.Rules()) != 0 {
+		t.Fatalf("unexpected number of rules '%d'", len(mb.Rules()))
+	}
+
+	if _, err := cc.request(controlUnban, "x"); err == nil {
+		t.Fatal("expected an error unbanning twice")
+	}
+	if _, err := cc.request("bogus"); err == nil {
+		t.Fatal("expected an error for an unknown request")
+	}
+}
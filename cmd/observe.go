@@ -0,0 +1,83 @@
+package cmd
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gnanderson/rbh/firewall"
+	"github.com/olekukonko/tablewriter"
+)
+
+// printReport writes the would-ban report to stdout
+func printReport(report *firewall.Report) {
+	entries := report.Entries()
+
+	fmt.Printf("\nobserved since %s, peers which would have been banned:\n\n", report.Since().Format(time.RFC3339))
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"IP", "Reason", "Version", "Ban Length", "Bans", "First Seen", "Last Seen", "Public Key"})
+
+	for _, entry := range entries {
+		table.Append([]string{
+			entry.IP.String(),
+			entry.Reason,
+			entry.Version,
+			entry.Duration.String(),
+			strconv.Itoa(entry.Bans),
+			entry.FirstSeen.Format(time.RFC3339),
+			entry.LastSeen.Format(time.RFC3339),
+			entry.PublicKey,
+		})
+	}
+
+	table.SetFooter([]string{"PEER COUNT", strconv.Itoa(len(entries)), "", "", "", "", "", ""})
+	table.SetBorder(false)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.Render()
+}
+
+// reportObserved prints the report every interval and whenever SIGUSR1 is
+// received
+func reportObserved(ctx context.Context, report *firewall.Report, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				signal.Stop(usr1)
+				return
+			case <-ticker.C:
+				printReport(report)
+			case <-usr1:
+				log.Println("run: report requested")
+				printReport(report)
+			}
+		}
+	}()
+}
@@ -0,0 +1,51 @@
+package cmd
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+
+	"github.com/gnanderson/rbh/firewall"
+	"github.com/gnanderson/xrpl"
+	"github.com/spf13/viper"
+)
+
+// newPolicy returns the ban policy from the 'policy' rules in the config, or
+// the default policy if there are none. xrpl.MinVersion must be set first.
+func newPolicy() (*firewall.Policy, error) {
+	if !viper.IsSet("policy") {
+		return firewall.DefaultPolicy(), nil
+	}
+
+	var rules []firewall.Rule
+	if err := viper.UnmarshalKey("policy", &rules); err != nil {
+		return nil, fmt.Errorf("policy: %v", err)
+	}
+
+	return firewall.NewPolicy(rules...)
+}
+
+// candidate returns the rule the peer is banned or observed by, nil if the
+// policy leaves it alone
+func candidate(policy *firewall.Policy, peer *xrpl.Peer) *firewall.Rule {
+	rule := policy.Evaluate(peer)
+	if rule == nil || rule.Action == firewall.RuleAllow {
+		return nil
+	}
+
+	return rule
+}
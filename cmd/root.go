@@ -75,6 +75,17 @@ func init() {
 	chk(viper.BindPFlag("tls", rootCmd.PersistentFlags().Lookup("tls")))
 }
 
+// bindFlags binds the named flags of the command being run to their config
+// keys. Some flags are shared between commands so this happens when the
+// command runs rather than in init.
+func bindFlags(cmd *cobra.Command, names ...string) {
+	for _, name := range names {
+		if err := viper.BindPFlag(name, cmd.Flags().Lookup(name)); err != nil {
+			panic(err)
+		}
+	}
+}
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile != "" {
@@ -18,14 +18,18 @@ limitations under the License.
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/coreos/go-semver/semver"
 	"github.com/gnanderson/rbh/firewall"
 	"github.com/gnanderson/xrpl"
-	"github.com/godbus/dbus"
 	"github.com/gorilla/websocket"
 	ws "github.com/maurodelazeri/gorilla-reconnect"
 	"github.com/spf13/cobra"
@@ -42,6 +46,7 @@ Periodically this service will query the XRPL node for a list of peers and decid
 whether to swing the ban hammer.`,
 
 	Run: func(cmd *cobra.Command, args []string) {
+		bindFlags(cmd, "backend", "ipset", "permanent", "observe", "report", "prefix4", "prefix6", "action", "reject-with", "reject-with6", "tarpit-port", "zone", "interface", "peer-port", "port-only", "log-limit", "control", "state", "disconnect", "docker", "tcpkill", "tcpkill-aggression", "tcpkill-timeout", "conntrack", "netns", "container-socket", "disconnect-workers", "disconnect-timeout", "disconnect-retries")
 		log.Println("run command exit:", run())
 	},
 }
@@ -49,7 +54,10 @@ whether to swing the ban hammer.`,
 var (
 	banLength, repeatCmd int
 	whitelist, container string
-	tcpkill              bool
+	tcpkill, observe     bool
+	reportInterval       int
+	prefix4, prefix6     int
+	stateFile            string
 )
 
 func init() {
@@ -57,12 +65,25 @@ func init() {
 	runCmd.Flags().IntVarP(&banLength, "banlength", "b", 1440, "the duration of the ban (in minutes) for unstable peers")
 	runCmd.Flags().IntVarP(&repeatCmd, "repeat", "r", 60, "check for new peers to ban after 'repeat' seconds")
 	runCmd.Flags().StringVarP(&whitelist, "whitelist", "w", "", "Space separated list of IP's which will not be considered as candidates for the ban hammer")
-	runCmd.Flags().StringVarP(&container, "docker", "d", "", "Optional name of a docker container to exec the socket close on.")
-	runCmd.Flags().BoolVarP(&tcpkill, "tcpkill", "k", false, "Use `tcpkill` instead of `ss -K` to close the banned peers socket.")
+	runCmd.Flags().StringVar(&backend, "backend", backendFirewalld, "Firewall backend used to enforce bans, one of 'firewalld', 'nftables' or 'iptables'.")
+	runCmd.Flags().BoolVar(&ipset, "ipset", false, "Ban peers with the firewalld ipsets rbh-<zone>-v4 and rbh-<zone>-v6 rather than a rich rule per peer, creating them reloads firewalld once at startup (firewalld backend only).")
+	runCmd.Flags().BoolVar(&permanent, "permanent", false, "Also write bans to the permanent firewalld config so they survive a firewalld restart or reboot, rbh removes them when they expire (firewalld backend only).")
+	runCmd.Flags().BoolVar(&observe, "observe", false, "Observe only, report the peers which would have been banned without touching the firewall or their sockets.")
+	runCmd.Flags().IntVar(&prefix4, "prefix4", 32, "Ban unstable IPv4 peers by the network of this prefix length, e.g. 24 bans the peers /24.")
+	runCmd.Flags().IntVar(&prefix6, "prefix6", 128, "Ban unstable IPv6 peers by the network of this prefix length, e.g. 64 bans the peers /64.")
+	runCmd.Flags().IntVar(&reportInterval, "report", 60, "print the observe mode report every 'report' minutes, it is also printed on SIGUSR1")
+	runCmd.Flags().StringVar(&stateFile, "state", "/var/lib/rbh/bans.json", "File the blacklist is saved to so bans can be restored after a restart, empty to disable.")
+	runCmd.Flags().StringVar(&controlSocket, "control", defaultControlSocket, "Control socket used by other rbh commands e.g. unban, empty to disable.")
+	actionFlags(runCmd)
+	zoneFlags(runCmd)
+	disconnectFlags(runCmd)
 }
 
 func run() error {
-	ctx, cancel := context.WithCancel(context.Background())
+	// SIGINT and SIGTERM stop polling, the bans are saved and the peers still
+	// queued to be disconnected are drained before exiting
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
 	n := xrpl.NewNode(
 		viper.GetString("addr"),
@@ -71,11 +92,19 @@ func run() error {
 	)
 
 	fw := firewall.NewFirewall(viper.GetInt("banlength"), viper.GetStringSlice("whitelist")...)
-	if viper.GetString("docker") != "" {
-		fw.Disconnector = firewall.NewSSDisconnector(viper.GetString("docker"))
+	if err := fw.Aggregate(viper.GetInt("prefix4"), viper.GetInt("prefix6")); err != nil {
+		log.Fatal("run:", err)
 	}
-	if viper.GetBool("tcpkill") {
-		fw.Disconnector = firewall.NewTCPKIllDisconnector(viper.GetString("docker"))
+	disconnector, chain, err := newDisconnector()
+	if err != nil {
+		log.Fatal("run: ", err)
+	}
+	if pool, ok := disconnector.(*firewall.DisconnectPool); ok {
+		pool.Context = ctx
+	}
+	fw.Disconnector = disconnector
+	if chain != nil && !viper.GetBool("observe") {
+		logChainStats(ctx, chain)
 	}
 
 	cmd := xrpl.NewPeerCommand()
@@ -83,11 +112,56 @@ func run() error {
 	cmd.AdminPassword = viper.GetString("passwd")
 	xrpl.MinVersion = semver.Must(semver.NewVersion(minVersion))
 
-	if err := firewall.Connect(); err != nil {
-		log.Fatal("run: firewall error:", err)
+	policy, err := newPolicy()
+	if err != nil {
+		log.Fatal("run: ", err)
+	}
+
+	var report *firewall.Report
+	if viper.GetBool("observe") {
+		if viper.GetInt("report") < 1 {
+			log.Fatal("invalid report interval, --report must be greater than zero")
+		}
+		log.Println("run: observe mode, no peers will be banned")
+		report = firewall.NewReport(viper.GetInt("banlength"), viper.GetStringSlice("whitelist")...)
+		reportObserved(ctx, report, time.Duration(viper.GetInt("report"))*time.Minute)
+	} else {
+		fwBackend, err := newBackend(viper.GetString("backend"))
+		if err != nil {
+			log.Fatal("run: firewall error:", err)
+		}
+		fw.Backend = fwBackend
+
+		// creating the ipsets reloads firewalld, which is only done here so
+		// a ban never drops the host's runtime rules
+		if fwd, ok := fwBackend.(*firewall.FirewalldBackend); ok && fwd.IPSet {
+			if err := fwd.CreateIPSets(); err != nil {
+				log.Fatal("run: firewall error:", err)
+			}
+		}
+
+		if fw.StateFile = viper.GetString("state"); fw.StateFile != "" {
+			if err := os.MkdirAll(filepath.Dir(fw.StateFile), 0700); err != nil {
+				log.Fatal("run: state: ", err)
+			}
+		}
+		restored, err := fw.Restore()
+		if err != nil {
+			log.Println("run: cannot restore bans:", err)
+		}
+		log.Println("run: restored", restored, "bans")
+
+		// firewalld tells us when it has been reloaded or restarted, other
+		// backends are reconciled as the blacklist is expired
+		reconcile := !fw.Watch(ctx)
+		expireBlacklist(ctx, fw, reconcile)
+
+		if path := viper.GetString("control"); path != "" {
+			if err := serveControl(ctx, path, fw); err != nil {
+				log.Fatal("run: ", err)
+			}
+		}
 	}
-	expireBlacklist(ctx, fw)
-	refreshBans(ctx, fw)
 
 	if repeatCmd < 1 {
 		log.Fatal("invalid repeat length, -r / --repeat must be greater than zero")
@@ -96,7 +170,21 @@ func run() error {
 
 	msgs := n.RepeatCommand(ctx, cmd, repeatCmd)
 
-	for msg := range msgs {
+poll:
+	for {
+		var msg *xrpl.WsMessage
+		select {
+		case <-ctx.Done():
+			log.Println("run: shutting down")
+			break poll
+		case m, ok := <-msgs:
+			if !ok {
+				log.Println("run: message channel closed")
+				break poll
+			}
+			msg = m
+		}
+
 		if msg.Err == nil {
 			pl, err := xrpl.UnmarshalPeers(string(msg.Msg))
 			if err != nil {
@@ -105,8 +193,16 @@ func run() error {
 			}
 
 			for _, peer := range pl.Peers() {
-				if !peer.StableWith(xrpl.DefaultStabilityChecker) && firewall.Up() {
-					fw.BanPeer(peer)
+				rule := candidate(policy, peer)
+				switch {
+				case rule == nil:
+					continue
+				case rule.Action == firewall.RuleObserve:
+					log.Println("run: policy observed", peer.Address, rule.Describe(peer))
+				case report != nil:
+					report.RecordForLength(peer, rule.Describe(peer), rule.BanLength)
+				default:
+					fw.BanPeerForLength(peer, rule.Reason, rule.BanLength)
 				}
 			}
 
@@ -122,30 +218,51 @@ func run() error {
 		<-time.After(time.Second * 1)
 	}
 
-	log.Println("run: message channel closed")
 	cancel()
+	if report != nil {
+		printReport(report)
+	}
+	fw.Close()
+	if chain != nil && !viper.GetBool("observe") {
+		printChainStats(chain)
+	}
 
 	return nil
 }
 
-func refreshBans(ctx context.Context, fwl *firewall.Firewall) {
-	notify := make(chan *dbus.Signal)
-	firewall.NotifyReload(notify)
+// logChainStats logs which disconnect strategies closed the sockets of banned
+// peers every hour, until the context is done
+func logChainStats(ctx context.Context, chain *firewall.ChainDisconnector) {
+	ticker := time.NewTicker(time.Hour)
 
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
+				ticker.Stop()
 				return
-			case <-notify:
-				log.Println("run: firewalld reloaded")
-				fwl.RefreshBans()
+			case <-ticker.C:
+				printChainStats(chain)
 			}
 		}
 	}()
 }
 
-func expireBlacklist(ctx context.Context, firewall *firewall.Firewall) {
+// printChainStats logs how many times each strategy closed a banned peer's
+// sockets, in the order they are tried, and how many times they all failed
+func printChainStats(chain *firewall.ChainDisconnector) {
+	worked, failed := chain.Stats()
+
+	stats := make([]string, 0, len(chain.Strategies)+1)
+	for _, strategy := range chain.Strategies {
+		stats = append(stats, fmt.Sprintf("%s %d", strategy.Name, worked[strategy.Name]))
+	}
+	stats = append(stats, fmt.Sprintf("failed %d", failed))
+
+	log.Println("run: disconnects by strategy:", strings.Join(stats, ", "))
+}
+
+func expireBlacklist(ctx context.Context, firewall *firewall.Firewall, reconcile bool) {
 	ticker := time.NewTicker(time.Second * 60)
 
 	go func() {
@@ -155,6 +272,11 @@ func expireBlacklist(ctx context.Context, firewall *firewall.Firewall) {
 				ticker.Stop()
 				return
 			case <-ticker.C:
+				if reconcile {
+					log.Println("run: reconciling firewall entries")
+					firewall.RefreshBans()
+					continue
+				}
 				log.Println("run: flushing expired firewall entries")
 				firewall.Expire()
 			}
@@ -17,12 +17,14 @@ limitations under the License.
 */
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"time"
 
 	"github.com/coreos/go-semver/semver"
+	"github.com/gnanderson/rbh/firewall"
 	"github.com/gnanderson/xrpl"
 	"github.com/olekukonko/tablewriter"
 	"github.com/spf13/cobra"
@@ -45,7 +47,7 @@ var showCmd = &cobra.Command{
 	Args:  cobra.MinimumNArgs(1),
 	Long: `Valid args:
 
-  candidates: show peers matching blacklist criteria
+  candidates: show peers matching a rule of the ban policy
   peers: show all connected peers
   stable: show all stable peers
   unstable show current unstable peers`,
@@ -74,6 +76,11 @@ func show(args []string) {
 	cmd.AdminPassword = viper.GetString("passwd")
 	xrpl.MinVersion = semver.Must(semver.NewVersion(minVersion))
 
+	policy, err := newPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	msg := n.DoCommand(cmd)
 	if msg == nil {
 		log.Println("no response")
@@ -125,10 +132,24 @@ func show(args []string) {
 		}
 	}
 
+	header := []string{"IP", "Status", "Version", "Uptime", "Latency", "Load", "Public Key"}
+	if arg == argCandidates {
+		header = append(header, "Rule")
+	}
+
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"IP", "Status", "Version", "Uptime", "Latency", "Load", "Public Key"})
+	table.SetHeader(header)
 
 	for _, peer := range peers {
+		// candidates are the peers rbh run would act on, the policy is
+		// evaluated before the status is changed for display
+		var rule *firewall.Rule
+		if arg == argCandidates {
+			if rule = candidate(policy, peer); rule == nil {
+				continue
+			}
+		}
+
 		if peer.TooOld() {
 			peer.Sanity = xrpl.Old
 		}
@@ -137,18 +158,15 @@ func show(args []string) {
 		}
 		line := lineFromPeer(peer)
 
-		if arg == argCandidates {
-			if !peer.StableWith(xrpl.DefaultStabilityChecker) {
-				line := lineFromPeer(peer)
-				table.Append(line)
-			}
-			continue
+		if rule != nil {
+			line = append(line, fmt.Sprintf("%s (%s)", rule.Name, rule.Action))
 		}
 		table.Append(line)
-
 	}
 
-	table.SetFooter([]string{"PEER COUNT", strconv.Itoa(table.NumLines()), "", "", "", "", ""})
+	footer := make([]string, len(header))
+	footer[0], footer[1] = "PEER COUNT", strconv.Itoa(table.NumLines())
+	table.SetFooter(footer)
 	table.SetBorder(false)
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
 	table.Render()
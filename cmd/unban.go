@@ -0,0 +1,98 @@
+package cmd
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"log"
+	"strings"
+
+	"github.com/gnanderson/rbh/firewall"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// unbanCmd represents the unban command
+var unbanCmd = &cobra.Command{
+	Use:   "unban <ip|cidr|pubkey>...",
+	Short: "lift one or more bans early",
+	Args:  cobra.MinimumNArgs(1),
+	Long: `Lift the bans on one or more IP addresses, CIDR networks or peer public keys
+provided as a space separated list of args.
+
+If rbh run is running the unban is handled by it, the peer is removed from its
+blacklist and won't be banned again until the ban length has passed. Otherwise
+the ban is removed from the firewall directly, this requires the same backend
+flags rbh run was started with. Public keys can only be unbanned by rbh run.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		bindFlags(cmd, "backend", "ipset", "action", "reject-with", "reject-with6", "tarpit-port", "zone", "interface", "peer-port", "port-only", "log-limit", "control")
+		unban(args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(unbanCmd)
+	unbanCmd.Flags().StringVar(&controlSocket, "control", defaultControlSocket, "Control socket of a running rbh.")
+	unbanCmd.Flags().StringVar(&backend, "backend", backendFirewalld, "Firewall backend used to enforce bans, one of 'firewalld', 'nftables' or 'iptables'.")
+	unbanCmd.Flags().BoolVar(&ipset, "ipset", false, "Remove peers from the firewalld ipsets rbh-<zone>-v4 and rbh-<zone>-v6 as well as their rich rules (firewalld backend only).")
+	actionFlags(unbanCmd)
+	zoneFlags(unbanCmd)
+}
+
+func unban(targets []string) {
+	if cc, err := dialControl(viper.GetString("control")); err == nil {
+		defer cc.Close()
+
+		for _, target := range targets {
+			lifted, err := cc.request(controlUnban, target)
+			if err != nil {
+				log.Println("unban:", target, err)
+				continue
+			}
+			log.Println("unbanned:", target, lifted)
+		}
+		return
+	}
+
+	fwBackend, err := newBackend(viper.GetString("backend"))
+	if err != nil {
+		log.Fatal("firewall unban:", err)
+	}
+
+	// the ban may have been written to the permanent config by `rbh run
+	// --permanent`, removing it from there too is harmless if it wasn't
+	if fwd, ok := fwBackend.(*firewall.FirewalldBackend); ok {
+		fwd.Permanent = true
+	}
+
+	fw := firewall.NewFirewall(banLength)
+	fw.Backend = fwBackend
+	defer fw.Close()
+
+	for _, target := range targets {
+		bans, err := fw.UnbanPeer(target)
+		if err != nil {
+			log.Println("unban:", target, err)
+			continue
+		}
+
+		lifted := make([]string, 0, len(bans))
+		for _, ban := range bans {
+			lifted = append(lifted, ban.CIDR())
+		}
+		log.Println("unbanned:", target, strings.Join(lifted, " "))
+	}
+}
@@ -0,0 +1,304 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gnanderson/xrpl"
+)
+
+// The actions a backend can take on traffic from a banned source
+const (
+	ActionDrop   = "drop"
+	ActionReject = "reject"
+	ActionTarpit = "tarpit"
+)
+
+// DefaultPeerPort is the port rippled listens on for peer connections
+const DefaultPeerPort = 51235
+
+// LogPrefix marks the rules rbh manages, it is followed by the reason for the
+// ban in the log prefix of the rule e.g. rbh:old-version
+const LogPrefix = "rbh:"
+
+// Reasons for bans which are not the result of a stability check
+const (
+	// ReasonBanned is used by rules covering many bans, e.g. a set
+	ReasonBanned = "banned"
+	// ReasonManual is used by bans made with rbh ban
+	ReasonManual = "manual"
+)
+
+// the longest reason, iptables limits a log prefix to 29 characters
+const maxReason = 20
+
+// log limits are a rate per second, minute, hour or day e.g. 10/m
+var logLimitRe = regexp.MustCompile(`^([1-9][0-9]*)/([smhd])$`)
+
+// ICMP types a banned source can be rejected with, these follow the iptables
+// and firewalld names
+var (
+	icmpTypes = map[string]uint8{
+		"icmp-net-unreachable":   0,
+		"icmp-host-unreachable":  1,
+		"icmp-proto-unreachable": 2,
+		"icmp-port-unreachable":  3,
+		"icmp-net-prohibited":    9,
+		"icmp-host-prohibited":   10,
+		"icmp-admin-prohibited":  13,
+	}
+	icmp6Types = map[string]uint8{
+		"icmp6-no-route":         0,
+		"icmp6-adm-prohibited":   1,
+		"icmp6-addr-unreachable": 3,
+		"icmp6-port-unreachable": 4,
+	}
+)
+
+// Action is what a backend does with traffic from a banned source. The zero
+// value drops it.
+type Action struct {
+	// Type is one of ActionDrop, ActionReject or ActionTarpit
+	Type string
+	// RejectWith and RejectWith6 are the ICMP and ICMPv6 types sent when
+	// rejecting, e.g. icmp-host-prohibited and icmp6-adm-prohibited. If unset
+	// the port unreachable default is sent.
+	RejectWith  string
+	RejectWith6 string
+	// ToPort is the local port a tarpit forwards the peer port to, something
+	// like endlessh should be listening there
+	ToPort int
+	// Port is the rippled peer port, DefaultPeerPort if unset. With PortOnly
+	// set the action is only taken on traffic to the peer port, and from it
+	// for replies on outbound connections to peers listening on the same
+	// port, so banned sources can still reach e.g. public RPC or websocket
+	// ports.
+	Port     int
+	PortOnly bool
+	// LogLimit is the rate traffic from banned sources is logged at e.g.
+	// 10/m, every packet is logged if unset
+	LogLimit string
+}
+
+// NewAction validates and returns an action, rejectWith and rejectWith6 are
+// only used to reject and toPort only used for a tarpit
+func NewAction(kind, rejectWith, rejectWith6 string, toPort int) (Action, error) {
+	action := Action{Type: kind}
+
+	switch kind {
+	case ActionDrop, "":
+		action.Type = ActionDrop
+	case ActionReject:
+		if _, ok := icmpTypes[rejectWith]; rejectWith != "" && !ok {
+			return action, fmt.Errorf("firewall: unknown icmp type '%s'", rejectWith)
+		}
+		if _, ok := icmp6Types[rejectWith6]; rejectWith6 != "" && !ok {
+			return action, fmt.Errorf("firewall: unknown icmp6 type '%s'", rejectWith6)
+		}
+		action.RejectWith = rejectWith
+		action.RejectWith6 = rejectWith6
+	case ActionTarpit:
+		if toPort <= 0 || toPort > 65535 {
+			return action, fmt.Errorf("firewall: invalid tarpit port '%d'", toPort)
+		}
+		action.ToPort = toPort
+	default:
+		return action, fmt.Errorf("firewall: unknown action '%s'", kind)
+	}
+
+	return action, nil
+}
+
+// WithPort returns the action scoped to the peer port if only is set, the port
+// is also the one a tarpit forwards
+func (a Action) WithPort(port int, only bool) (Action, error) {
+	if port <= 0 || port > 65535 {
+		return a, fmt.Errorf("firewall: invalid peer port '%d'", port)
+	}
+
+	a.Port = port
+	a.PortOnly = only
+
+	return a, nil
+}
+
+// WithLogLimit returns the action logging at most limit packets, a rate per
+// second, minute, hour or day e.g. 10/m. An empty limit logs every packet.
+func (a Action) WithLogLimit(limit string) (Action, error) {
+	if limit != "" && !logLimitRe.MatchString(limit) {
+		return a, fmt.Errorf("firewall: invalid log limit '%s', expected e.g. 10/m", limit)
+	}
+
+	a.LogLimit = limit
+
+	return a, nil
+}
+
+// the log limit as a rate and the unit it is per, a zero rate is no limit
+func (a Action) logLimit() (uint64, time.Duration) {
+	match := logLimitRe.FindStringSubmatch(a.LogLimit)
+	if match == nil {
+		return 0, 0
+	}
+
+	rate, _ := strconv.ParseUint(match[1], 10, 64)
+	unit := map[string]time.Duration{
+		"s": time.Second,
+		"m": time.Minute,
+		"h": time.Hour,
+		"d": 24 * time.Hour,
+	}[match[2]]
+
+	return rate, unit
+}
+
+// Reason returns why a peer failed the default stability check, as used in
+// the log prefix of its rule. A peer reporting no sanity is good, the same as
+// in a Policy.
+func Reason(peer *xrpl.Peer) string {
+	if peer.Sanity == xrpl.Old {
+		return "old-version"
+	}
+
+	return cleanReason("sanity-" + peerSanity(peer))
+}
+
+// cleanReason makes a reason safe to use in a log prefix, anything but
+// letters, digits, dots, dashes and underscores is replaced
+func cleanReason(reason string) string {
+	clean := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, reason)
+
+	if len(clean) > maxReason {
+		clean = clean[:maxReason]
+	}
+	if clean == "" {
+		return ReasonBanned
+	}
+
+	return clean
+}
+
+// the log prefix marking a rule as rbh's
+func logPrefix(reason string) string {
+	return LogPrefix + cleanReason(reason)
+}
+
+// the peer port
+func (a Action) port() int {
+	if a.Port == 0 {
+		return DefaultPeerPort
+	}
+
+	return a.Port
+}
+
+// scoped returns true if only traffic to or from the peer port is matched, a
+// tarpit only ever matches traffic to the peer port
+func (a Action) scoped() bool {
+	return a.PortOnly && a.kind() != ActionTarpit
+}
+
+// kind returns the action type, defaulting to drop
+func (a Action) kind() string {
+	if a.Type == "" {
+		return ActionDrop
+	}
+
+	return a.Type
+}
+
+// the ICMP type to reject with for the address family
+func (a Action) rejectWith(v6 bool) string {
+	if v6 {
+		return a.RejectWith6
+	}
+
+	return a.RejectWith
+}
+
+// the rich rules' port, log and action elements for the address family, see
+// firewalld.richlanguage(5). A rich rule has a single port element, so a port
+// scoped action takes a rule for traffic to the peer port and another for
+// traffic from it. The log prefix marks the rules as rbh's. The elements are
+// in the order firewalld lists them, a tarpit's forward-port is an element
+// rather than an action so it comes before the log.
+func (a Action) richActions(v6 bool, reason string) []string {
+	logged := fmt.Sprintf("log prefix='%s'", logPrefix(reason))
+	if a.LogLimit != "" {
+		logged = fmt.Sprintf("log prefix='%s' limit value='%s'", logPrefix(reason), a.LogLimit)
+	}
+
+	verdict := "drop"
+	switch a.kind() {
+	case ActionReject:
+		verdict = "reject"
+		if with := a.rejectWith(v6); with != "" {
+			verdict = fmt.Sprintf("reject type='%s'", with)
+		}
+	case ActionTarpit:
+		return []string{fmt.Sprintf(
+			"forward-port port='%d' protocol='tcp' to-port='%d' %s",
+			a.port(),
+			a.ToPort,
+			logged,
+		)}
+	}
+
+	if !a.scoped() {
+		return []string{logged + " " + verdict}
+	}
+
+	return []string{
+		fmt.Sprintf("port port='%d' protocol='tcp' %s %s", a.port(), logged, verdict),
+		fmt.Sprintf("source-port port='%d' protocol='tcp' %s %s", a.port(), logged, verdict),
+	}
+}
+
+func (a Action) String() string {
+	var str string
+
+	switch a.kind() {
+	case ActionReject:
+		str = "reject"
+		if a.RejectWith != "" || a.RejectWith6 != "" {
+			str = fmt.Sprintf("reject with %s/%s", a.RejectWith, a.RejectWith6)
+		}
+	case ActionTarpit:
+		return fmt.Sprintf("tarpit port %d to port %d", a.port(), a.ToPort)
+	default:
+		str = "drop"
+	}
+
+	if a.scoped() {
+		str += fmt.Sprintf(" on port %d", a.port())
+	}
+
+	return str
+}
@@ -21,12 +21,14 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"os/exec"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gnanderson/xrpl"
+	"github.com/vishvananda/netlink"
 )
 
 // Disconnector is an interface accepted by the firewall to disconnect a peers
@@ -35,6 +37,27 @@ type Disconnector interface {
 	Disconnect(peer *xrpl.Peer) error
 }
 
+// ContextDisconnector is a Disconnector which gives up when the context is
+// done, e.g. by killing the command it runs. A DisconnectPool cancels the
+// context of an attempt which times out.
+type ContextDisconnector interface {
+	Disconnector
+	DisconnectContext(ctx context.Context, peer *xrpl.Peer) error
+}
+
+// disconnectContext disconnects the peer with the context if the Disconnector
+// is a ContextDisconnector, otherwise the context is only checked first
+func disconnectContext(ctx context.Context, d Disconnector, peer *xrpl.Peer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cd, ok := d.(ContextDisconnector); ok {
+		return cd.DisconnectContext(ctx, peer)
+	}
+
+	return d.Disconnect(peer)
+}
+
 // SSDisconnector uses the ss utility from the iproute2 suite of packages. The
 // option used is `ss -K [filter]` where filter identifies the IP address of the
 // peer. Here is the description from the man page.
@@ -51,10 +74,15 @@ type Disconnector interface {
 // This Disconnector will execute a command similar to the following
 //    `ss -K dst 192.168.1.10`
 //
+// If Port is set only the peer protocol sockets are closed, i.e. those with
+// the port at either end, leaving any RPC or websocket connections open.
+//    `ss -K dst 192.168.1.10 ( sport = :51235 or dport = :51235 )`
+//
 // Needless to say, this requires root or elevated privileges.
 type SSDisconnector struct {
 	Docker    bool
 	Container string
+	Port      int
 }
 
 // NewSSDisconnector returns a Disconnector configured to use `ss -K`
@@ -67,16 +95,25 @@ var DefaultDisconnector = &SSDisconnector{}
 
 // Disconnect will try to close the peer's socket
 func (ssd *SSDisconnector) Disconnect(peer *xrpl.Peer) error {
+	return ssd.DisconnectContext(context.Background(), peer)
+}
+
+// DisconnectContext will try to close the peer's socket, ss is killed if the
+// context is done first
+func (ssd *SSDisconnector) DisconnectContext(ctx context.Context, peer *xrpl.Peer) error {
 	var out bytes.Buffer
 	var cmdStr = "ss"
 	var args = []string{"-K", "-H", fmt.Sprintf("dst %s", peer.IP().String())}
+	if ssd.Port > 0 {
+		args = append(args, fmt.Sprintf("( sport = :%d or dport = :%d )", ssd.Port, ssd.Port))
+	}
 
 	if ssd.Docker {
 		cmdStr = "docker"
 		args = append([]string{"exec", ssd.Container, "ss"}, args...)
 	}
 
-	cmd := exec.Command(cmdStr, args...)
+	cmd := exec.CommandContext(ctx, cmdStr, args...)
 	cmd.Stdout = &out
 	err := cmd.Run()
 
@@ -100,13 +137,34 @@ func (ssd *SSDisconnector) Disconnect(peer *xrpl.Peer) error {
 // and then aggressively trying to inject a RST packet into the TCP stack
 // receive window. For this reason it may not be successful, but you can try
 // more aggressive levels than the default (3), levels are 1-9.
+//
+// tcpkill sniffs the Interface, by default the interface of the route to the
+// peer, for traffic on the peer port, with a filter similar to the following
+//    `tcpkill -i eth0 -3 host 192.168.1.10 and port 51235`
+//
+// For an outbound peer the peer's own port is included in the filter, unless
+// PortOnly is set to match port scoped bans. tcpkill runs until it is killed,
+// which happens after Timeout.
 type TCPKillDisconnector struct {
 	Aggression int
-	iface      string
-	Docker     bool
-	Container  string
+	// Interface sniffed, if empty the interface of the route to the peer, or
+	// tcpkill's default in a docker container
+	Interface string
+	// Port is the local rippled peer port, DefaultPeerPort if zero
+	Port int
+	// PortOnly only resets traffic on the Port, as a port scoped ban only
+	// matches traffic to or from it
+	PortOnly bool
+	// Timeout is how long tcpkill is left running, DefaultTCPKillTimeout if
+	// zero
+	Timeout   time.Duration
+	Docker    bool
+	Container string
 }
 
+// DefaultTCPKillTimeout is how long tcpkill is left to run by default
+const DefaultTCPKillTimeout = 500 * time.Millisecond
+
 // NewTCPKIllDisconnector returns a Disconnector configured to use `tcpkill`
 func NewTCPKIllDisconnector(container string) *TCPKillDisconnector {
 	return &TCPKillDisconnector{
@@ -118,35 +176,102 @@ func NewTCPKIllDisconnector(container string) *TCPKillDisconnector {
 
 // Disconnect will try to close the peer's socket
 func (tcp *TCPKillDisconnector) Disconnect(peer *xrpl.Peer) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	var out bytes.Buffer
-	var cmdStr = "tcpkill"
-	var args = []string{"-i", tcp.iface, strconv.Itoa(tcp.Aggression)}
+	return tcp.DisconnectContext(context.Background(), peer)
+}
+
+// DisconnectContext will try to close the peer's socket, tcpkill is killed
+// early if the context is done before the Timeout
+func (tcp *TCPKillDisconnector) DisconnectContext(ctx context.Context, peer *xrpl.Peer) error {
+	args, err := tcp.args(peer)
+	if err != nil {
+		return err
+	}
 
+	var cmdStr = "tcpkill"
 	if tcp.Docker {
 		cmdStr = "docker"
 		args = append([]string{"exec", tcp.Container, "tcpkill"}, args...)
 	}
 
-	cmd := exec.CommandContext(ctx, cmdStr, args...)
+	timeout := tcp.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTCPKillTimeout
+	}
+	run, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// tcpkill reports the resets it sends on stderr
+	var out bytes.Buffer
+	cmd := exec.CommandContext(run, cmdStr, args...)
 	cmd.Stdout = &out
+	cmd.Stderr = &out
 
-	timeout := time.After(500 * time.Millisecond)
-	errCh := make(chan error)
+	err = cmd.Run()
+	// tcpkill only stops when it is killed
+	if run.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		err = nil
+	}
 
-	go func() {
-		err := cmd.Run()
-		errCh <- err
-	}()
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line != "" {
+			log.Println("firewall disconnect: tcpkill:", line)
+		}
+	}
 
-	select {
-	case err := <-errCh:
-		cancel()
-		return err
-	case <-timeout:
-		cancel()
-		log.Println(out)
+	return err
+}
+
+// the tcpkill arguments for the peer
+func (tcp *TCPKillDisconnector) args(peer *xrpl.Peer) ([]string, error) {
+	ip := peerIP(peer)
+	if ip == nil {
+		return nil, fmt.Errorf("firewall disconnect: invalid peer address '%s'", peer.Address)
+	}
+
+	if tcp.Aggression < 1 || tcp.Aggression > 9 {
+		return nil, fmt.Errorf("firewall disconnect: invalid tcpkill aggression '%d', levels are 1-9", tcp.Aggression)
+	}
+
+	iface := tcp.Interface
+	if iface == "" && !tcp.Docker {
+		var err error
+		if iface, err = routeInterface(ip); err != nil {
+			return nil, err
+		}
+	}
+
+	var args []string
+	if iface != "" {
+		args = append(args, "-i", iface)
+	}
+	args = append(args, "-"+strconv.Itoa(tcp.Aggression))
+
+	port := tcp.Port
+	if port == 0 {
+		port = DefaultPeerPort
+	}
+	filter := fmt.Sprintf("host %s and port %d", ip, port)
+	if !peer.Inbound && !tcp.PortOnly {
+		_, remote, _ := net.SplitHostPort(peer.Address)
+		if remote != "" && remote != strconv.Itoa(port) {
+			filter = fmt.Sprintf("host %s and (port %d or port %s)", ip, port, remote)
+		}
+	}
+
+	return append(args, filter), nil
+}
+
+// the name of the interface traffic to the IP address is routed through
+func routeInterface(ip net.IP) (string, error) {
+	routes, err := netlink.RouteGet(ip)
+	if err != nil || len(routes) == 0 {
+		return "", fmt.Errorf("firewall disconnect: no route to %s: %v", ip, err)
+	}
+
+	link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		return "", fmt.Errorf("firewall disconnect: route to %s: %v", ip, err)
 	}
 
-	return nil
+	return link.Attrs().Name, nil
 }
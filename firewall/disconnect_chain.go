@@ -0,0 +1,164 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/gnanderson/xrpl"
+)
+
+// Strategy is a Disconnector tried by a ChainDisconnector, the name is used
+// to record which strategy closed a peer's sockets
+type Strategy struct {
+	Name string
+	Disconnector
+	// Unverifiable is set if the strategy closes what the chain cannot count,
+	// e.g. sockets in a docker container or conntrack flows, so the chain
+	// cannot tell whether it worked
+	Unverifiable bool
+}
+
+// ChainDisconnector tries each of its strategies in order until the peer's
+// sockets are gone, e.g. netlink, then `ss -K`, then conntrack, then tcpkill.
+// After each attempt the sockets still open to the peer are counted with
+// inet_diag, as a NetlinkDisconnector on Port would find them, and the chain
+// stops at the first strategy which leaves none.
+//
+// Only sockets in rbh's network namespace can be counted. If the peer has none
+// open there the first strategy is still tried, along with each Unverifiable
+// strategy, as the sockets may be where they cannot be counted. The chain stops
+// at the first Unverifiable strategy which leaves no sockets to be counted.
+type ChainDisconnector struct {
+	Strategies []Strategy
+	// Port is the local rippled peer port, DefaultPeerPort if zero
+	Port int
+
+	// count the sockets open to the peer, replaced in tests
+	open func(peer *xrpl.Peer) (int, error)
+
+	mu     sync.Mutex
+	worked map[string]int
+	failed int
+}
+
+// NewChainDisconnector returns a Disconnector trying the strategies in order
+// until the peer's sockets on the peer port are closed
+func NewChainDisconnector(port int, strategies ...Strategy) *ChainDisconnector {
+	return &ChainDisconnector{Strategies: strategies, Port: port}
+}
+
+// Disconnect tries each strategy in turn until the peer's sockets are closed,
+// an error is returned if they survive every strategy
+func (cd *ChainDisconnector) Disconnect(peer *xrpl.Peer) error {
+	return cd.DisconnectContext(context.Background(), peer)
+}
+
+// DisconnectContext is Disconnect giving up on the strategies left when the
+// context is done, the context is passed on to each ContextDisconnector
+func (cd *ChainDisconnector) DisconnectContext(ctx context.Context, peer *xrpl.Peer) error {
+	open, err := cd.count(peer)
+	if err != nil {
+		return err
+	}
+	counted := open > 0
+
+	for i, strategy := range cd.Strategies {
+		if i > 0 && open == 0 && !strategy.Unverifiable {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := disconnectContext(ctx, strategy.Disconnector, peer); err != nil {
+			log.Println(fmt.Sprintf("firewall disconnect: %s: %v", strategy.Name, err))
+		}
+
+		if open, err = cd.count(peer); err != nil {
+			return err
+		}
+		if open > 0 {
+			continue
+		}
+
+		if strategy.Unverifiable {
+			cd.record(strategy.Name)
+			log.Println(fmt.Sprintf("firewall disconnect: %s tried closing the sockets to %s, this cannot be verified", strategy.Name, peer.Address))
+			return nil
+		}
+		if counted {
+			cd.record(strategy.Name)
+			log.Println(fmt.Sprintf("firewall disconnect: %s closed the sockets to %s", strategy.Name, peer.Address))
+			return nil
+		}
+	}
+
+	if open == 0 {
+		log.Println("firewall disconnect: no sockets open to", peer.Address)
+		return nil
+	}
+
+	cd.record("")
+
+	return fmt.Errorf("firewall disconnect: %d sockets to %s survived every strategy", open, peer.Address)
+}
+
+// Stats returns how many times each strategy closed a peer's sockets, or was
+// the Unverifiable strategy the chain stopped at, and how many times they all
+// failed to
+func (cd *ChainDisconnector) Stats() (map[string]int, int) {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+
+	worked := make(map[string]int, len(cd.worked))
+	for name, count := range cd.worked {
+		worked[name] = count
+	}
+
+	return worked, cd.failed
+}
+
+// record the strategy which worked, or a failure if the name is empty
+func (cd *ChainDisconnector) record(name string) {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+
+	if name == "" {
+		cd.failed++
+		return
+	}
+
+	if cd.worked == nil {
+		cd.worked = make(map[string]int)
+	}
+	cd.worked[name]++
+}
+
+// the number of sockets open to the peer
+func (cd *ChainDisconnector) count(peer *xrpl.Peer) (int, error) {
+	if cd.open != nil {
+		return cd.open(peer)
+	}
+
+	sockets, err := NewNetlinkDisconnector(cd.Port).Sockets(peer)
+
+	return len(sockets), err
+}
@@ -0,0 +1,142 @@
+package firewall
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gnanderson/xrpl"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// fakeSockets closes the peer's sockets when the strategy it is given is tried
+type fakeSockets struct {
+	open   int
+	closes string
+	tried  []string
+}
+
+func (fs *fakeSockets) strategy(name string, err error) Strategy {
+	return Strategy{Name: name, Disconnector: disconnectFunc(func(peer *xrpl.Peer) error {
+		fs.tried = append(fs.tried, name)
+		if name == fs.closes {
+			fs.open = 0
+		}
+		return err
+	})}
+}
+
+type disconnectFunc func(peer *xrpl.Peer) error
+
+func (f disconnectFunc) Disconnect(peer *xrpl.Peer) error {
+	return f(peer)
+}
+
+func newTestChain(fs *fakeSockets) *ChainDisconnector {
+	cd := NewChainDisconnector(0,
+		fs.strategy("netlink", errors.New("unsupported")),
+		fs.strategy("ss", nil),
+		fs.strategy("tcpkill", nil),
+	)
+	cd.open = func(peer *xrpl.Peer) (int, error) { return fs.open, nil }
+
+	return cd
+}
+
+func TestChainStopsAtFirstSuccess(t *testing.T) {
+	fs := &fakeSockets{open: 2, closes: "ss"}
+	cd := newTestChain(fs)
+
+	if err := cd.Disconnect(&xrpl.Peer{Address: "192.0.2.10:51235"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.tried) != 2 || fs.tried[1] != "ss" {
+		t.Errorf("expected netlink then ss to be tried, tried %v", fs.tried)
+	}
+
+	worked, failed := cd.Stats()
+	if worked["ss"] != 1 || len(worked) != 1 || failed != 0 {
+		t.Errorf("expected ss to be recorded, got %v and %d failures", worked, failed)
+	}
+}
+
+func TestChainAllFail(t *testing.T) {
+	fs := &fakeSockets{open: 1}
+	cd := newTestChain(fs)
+
+	if err := cd.Disconnect(&xrpl.Peer{Address: "192.0.2.10:51235"}); err == nil {
+		t.Fatal("expected an error when the sockets survive")
+	}
+	if len(fs.tried) != 3 {
+		t.Errorf("expected every strategy to be tried, tried %v", fs.tried)
+	}
+
+	worked, failed := cd.Stats()
+	if len(worked) != 0 || failed != 1 {
+		t.Errorf("expected a failure to be recorded, got %v and %d failures", worked, failed)
+	}
+}
+
+func TestChainNoSockets(t *testing.T) {
+	fs := &fakeSockets{}
+	cd := newTestChain(fs)
+
+	if err := cd.Disconnect(&xrpl.Peer{Address: "192.0.2.10:51235"}); err != nil {
+		t.Fatal(err)
+	}
+	// the sockets may be where they cannot be counted, so the first strategy
+	// is tried regardless
+	if len(fs.tried) != 1 || fs.tried[0] != "netlink" {
+		t.Errorf("expected only netlink to be tried, tried %v", fs.tried)
+	}
+
+	worked, failed := cd.Stats()
+	if len(worked) != 0 || failed != 0 {
+		t.Errorf("expected nothing to be recorded, got %v and %d failures", worked, failed)
+	}
+}
+
+func TestChainUnverifiable(t *testing.T) {
+	// ss runs in a docker container, its sockets cannot be counted
+	fs := &fakeSockets{}
+	cd := newTestChain(fs)
+	cd.Strategies[1].Unverifiable = true
+
+	if err := cd.Disconnect(&xrpl.Peer{Address: "192.0.2.10:51235"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.tried) != 2 || fs.tried[1] != "ss" {
+		t.Errorf("expected netlink then ss to be tried, tried %v", fs.tried)
+	}
+
+	worked, _ := cd.Stats()
+	if worked["ss"] != 1 || len(worked) != 1 {
+		t.Errorf("expected ss to be recorded, got %v", worked)
+	}
+
+	// sockets which can still be counted are not left open
+	fs = &fakeSockets{open: 1, closes: "tcpkill"}
+	cd = newTestChain(fs)
+	cd.Strategies[1].Unverifiable = true
+
+	if err := cd.Disconnect(&xrpl.Peer{Address: "192.0.2.10:51235"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.tried) != 3 {
+		t.Errorf("expected every strategy to be tried, tried %v", fs.tried)
+	}
+}
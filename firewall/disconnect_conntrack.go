@@ -0,0 +1,153 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/gnanderson/xrpl"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ConntrackDisconnector deletes the conntrack entries of a peer via the
+// nf_conntrack netlink interface. Established flows are otherwise allowed to
+// continue past a new ban by rules accepting related and established
+// traffic, and when rippled is behind NAT or in a docker container the socket
+// is not visible to `ss -K` in the host namespace, so deleting the entry is
+// the only way to cut the flow from the host.
+//
+// The entries deleted are those of flows from the peer's IP address, and of
+// flows to it. If Port is set only flows to the local peer port are deleted,
+// along with the flow to the peer's own port if the peer is outbound.
+//
+// If Sockets is set it is used to close the peer's sockets before the entries
+// are deleted, e.g. a NetlinkDisconnector. Requires root or CAP_NET_ADMIN.
+type ConntrackDisconnector struct {
+	Port    int
+	Sockets Disconnector
+}
+
+// NewConntrackDisconnector returns a Disconnector deleting the conntrack
+// entries of peers after closing their sockets with the Disconnector given,
+// which may be nil to only delete the entries
+func NewConntrackDisconnector(sockets Disconnector) *ConntrackDisconnector {
+	return &ConntrackDisconnector{Sockets: sockets}
+}
+
+// Disconnect will try to close the peer's sockets then delete its conntrack
+// entries. The entries are deleted even if the sockets cannot be closed, the
+// first error is returned.
+func (cd *ConntrackDisconnector) Disconnect(peer *xrpl.Peer) error {
+	return cd.DisconnectContext(context.Background(), peer)
+}
+
+// DisconnectContext is Disconnect with the context passed on to Sockets if it
+// is a ContextDisconnector
+func (cd *ConntrackDisconnector) DisconnectContext(ctx context.Context, peer *xrpl.Peer) error {
+	var sockErr error
+	if cd.Sockets != nil {
+		sockErr = disconnectContext(ctx, cd.Sockets, peer)
+	}
+
+	deleted, err := cd.Flush(peer)
+	if err != nil {
+		if sockErr != nil {
+			return sockErr
+		}
+		return err
+	}
+
+	log.Println(fmt.Sprintf("firewall disconnect: deleted %d conntrack entries for %s", deleted, peer.Address))
+
+	return sockErr
+}
+
+// Flush deletes the peer's conntrack entries returning the number deleted
+func (cd *ConntrackDisconnector) Flush(peer *xrpl.Peer) (int, error) {
+	ip := peerIP(peer)
+	if ip == nil {
+		return 0, fmt.Errorf("firewall disconnect: invalid peer address '%s'", peer.Address)
+	}
+
+	filters, err := cd.filters(peer, ip)
+	if err != nil {
+		return 0, err
+	}
+
+	var family netlink.InetFamily = unix.AF_INET6
+	if ip.To4() != nil {
+		family = unix.AF_INET
+	}
+
+	deleted, err := netlink.ConntrackDeleteFilters(netlink.ConntrackTable, family, filters...)
+	if err != nil {
+		return 0, fmt.Errorf("firewall disconnect: conntrack: %v", err)
+	}
+
+	return int(deleted), nil
+}
+
+// the filters matching the peer's flows, from it and to it
+func (cd *ConntrackDisconnector) filters(peer *xrpl.Peer, ip net.IP) ([]netlink.CustomConntrackFilter, error) {
+	from, err := conntrackFilter(netlink.ConntrackOrigSrcIP, ip, cd.Port)
+	if err != nil {
+		return nil, err
+	}
+	filters := []netlink.CustomConntrackFilter{from}
+
+	remote := 0
+	if cd.Port > 0 {
+		if peer.Inbound {
+			return filters, nil
+		}
+		_, port, _ := net.SplitHostPort(peer.Address)
+		if remote, _ = strconv.Atoi(port); remote == 0 {
+			return filters, nil
+		}
+	}
+
+	to, err := conntrackFilter(netlink.ConntrackOrigDstIP, ip, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(filters, to), nil
+}
+
+// a filter on the IP address, and TCP destination port if not zero
+func conntrackFilter(kind netlink.ConntrackFilterType, ip net.IP, port int) (*netlink.ConntrackFilter, error) {
+	filter := &netlink.ConntrackFilter{}
+	if err := filter.AddIP(kind, ip); err != nil {
+		return nil, err
+	}
+
+	if port > 0 {
+		if err := filter.AddProtocol(unix.IPPROTO_TCP); err != nil {
+			return nil, err
+		}
+		if err := filter.AddPort(netlink.ConntrackOrigDstPort, uint16(port)); err != nil {
+			return nil, err
+		}
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,98 @@
+package firewall
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/gnanderson/xrpl"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func tcpFlow(src string, sport int, dst string, dport int) *netlink.ConntrackFlow {
+	return &netlink.ConntrackFlow{Forward: netlink.IPTuple{
+		Protocol: unix.IPPROTO_TCP,
+		SrcIP:    net.ParseIP(src),
+		SrcPort:  uint16(sport),
+		DstIP:    net.ParseIP(dst),
+		DstPort:  uint16(dport),
+	}}
+}
+
+var conntrackTests = []struct {
+	port    int
+	inbound bool
+	flow    *netlink.ConntrackFlow
+	match   bool
+}{
+	// any flow from or to the peer
+	{0, true, tcpFlow("192.0.2.10", 40000, "198.51.100.1", 51235), true},
+	{0, true, tcpFlow("192.0.2.10", 40000, "198.51.100.1", 443), true},
+	{0, true, tcpFlow("198.51.100.1", 40000, "192.0.2.10", 443), true},
+	{0, true, tcpFlow("192.0.2.11", 40000, "198.51.100.1", 51235), false},
+	// only the peer port, and the outbound peer's own port
+	{51235, true, tcpFlow("192.0.2.10", 40000, "198.51.100.1", 51235), true},
+	{51235, true, tcpFlow("192.0.2.10", 40000, "198.51.100.1", 443), false},
+	{51235, true, tcpFlow("198.51.100.1", 40000, "192.0.2.10", 51236), false},
+	{51235, false, tcpFlow("198.51.100.1", 40000, "192.0.2.10", 51236), true},
+	{51235, false, tcpFlow("198.51.100.1", 40000, "192.0.2.10", 443), false},
+}
+
+func TestConntrackFilters(t *testing.T) {
+	for i, tt := range conntrackTests {
+		cd := &ConntrackDisconnector{Port: tt.port}
+		peer := &xrpl.Peer{Address: "192.0.2.10:51236", Inbound: tt.inbound}
+
+		filters, err := cd.filters(peer, peerIP(peer))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		match := false
+		for _, filter := range filters {
+			match = match || filter.MatchConntrackFlow(tt.flow)
+		}
+		if match != tt.match {
+			t.Errorf("%d: flow %s expected match %v", i, tt.flow, tt.match)
+		}
+	}
+}
+
+type errDisconnector struct {
+	called bool
+}
+
+func (ed *errDisconnector) Disconnect(peer *xrpl.Peer) error {
+	ed.called = true
+	return errors.New("socket not found")
+}
+
+func TestConntrackAfterSockets(t *testing.T) {
+	sockets := &errDisconnector{}
+	cd := NewConntrackDisconnector(sockets)
+
+	err := cd.Disconnect(&xrpl.Peer{Address: "192.0.2.10:51235", Inbound: true})
+	if !sockets.called {
+		t.Fatal("expected the sockets to be closed first")
+	}
+	if err == nil || err.Error() != "socket not found" {
+		t.Errorf("expected the socket error to be returned, got %v", err)
+	}
+}
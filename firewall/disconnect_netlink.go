@@ -0,0 +1,190 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/gnanderson/xrpl"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// NetlinkDisconnector closes a peer's sockets by sending SOCK_DESTROY
+// inet_diag messages to the kernel directly, rather than running `ss -K`. The
+// sockets closed are the TCP sockets from the peer's IP address to the local
+// rippled peer Port, and for an outbound peer the socket to the peer's own
+// port. Other sockets to the peer, e.g. RPC or websocket connections or our
+// own connections to other services on the peer, are left open.
+//
+// As with `ss -K` this requires Linux 4.9 or higher with the
+// `CONFIG_INET_DIAG_DESTROY` option compiled in, and root or CAP_NET_ADMIN.
+type NetlinkDisconnector struct {
+	// Port is the local rippled peer port, DefaultPeerPort if zero
+	Port int
+}
+
+// NewNetlinkDisconnector returns a Disconnector closing sockets on the peer
+// port with SOCK_DESTROY
+func NewNetlinkDisconnector(port int) *NetlinkDisconnector {
+	return &NetlinkDisconnector{Port: port}
+}
+
+// Disconnect will try to close the peer's sockets
+func (nd *NetlinkDisconnector) Disconnect(peer *xrpl.Peer) error {
+	closed, err := nd.Destroy(peer)
+	if err != nil {
+		return err
+	}
+
+	if closed == 0 {
+		log.Println("firewall disconnect: no sockets open to", peer.Address)
+		return nil
+	}
+
+	log.Println(fmt.Sprintf("firewall disconnect: closed %d sockets to %s", closed, peer.Address))
+
+	return nil
+}
+
+// Destroy closes the peer's sockets returning the number actually closed.
+// Sockets which close before they can be destroyed are not counted.
+func (nd *NetlinkDisconnector) Destroy(peer *xrpl.Peer) (int, error) {
+	sockets, err := nd.Sockets(peer)
+	if err != nil {
+		return 0, err
+	}
+
+	closed := 0
+	for _, socket := range sockets {
+		err := destroySocket(socket)
+		if errors.Is(err, unix.ENOENT) {
+			continue
+		}
+		if err != nil {
+			return closed, fmt.Errorf("firewall disconnect: SOCK_DESTROY: %w", err)
+		}
+		closed++
+	}
+
+	return closed, nil
+}
+
+// Sockets returns the peer's open sockets which Destroy would close
+func (nd *NetlinkDisconnector) Sockets(peer *xrpl.Peer) ([]*netlink.Socket, error) {
+	ip := peerIP(peer)
+	if ip == nil {
+		return nil, fmt.Errorf("firewall disconnect: invalid peer address '%s'", peer.Address)
+	}
+
+	remote := 0
+	if !peer.Inbound {
+		_, port, _ := net.SplitHostPort(peer.Address)
+		remote, _ = strconv.Atoi(port)
+	}
+
+	matched := make([]*netlink.Socket, 0)
+	// IPv4 peers may be connected to a dual stack IPv6 socket
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		sockets, err := netlink.SocketDiagTCP(family)
+		if err != nil {
+			return nil, fmt.Errorf("firewall disconnect: inet_diag: %v", err)
+		}
+
+		for _, socket := range sockets {
+			// sockets already closing are left to finish
+			if socket.State == netlink.TCP_TIME_WAIT || socket.State == netlink.TCP_CLOSE {
+				continue
+			}
+			if socketMatches(socket, ip, nd.port(), remote) {
+				matched = append(matched, socket)
+			}
+		}
+	}
+
+	return matched, nil
+}
+
+func (nd *NetlinkDisconnector) port() int {
+	if nd.Port == 0 {
+		return DefaultPeerPort
+	}
+
+	return nd.Port
+}
+
+// a socket matches if it is to the IP address and either on the local port or,
+// if set, to the remote port
+func socketMatches(socket *netlink.Socket, ip net.IP, local, remote int) bool {
+	if !socket.ID.Destination.Equal(ip) {
+		return false
+	}
+
+	return int(socket.ID.SourcePort) == local || (remote > 0 && int(socket.ID.DestinationPort) == remote)
+}
+
+// destroyRequest is the inet_diag_req_v2 struct identifying a single socket
+// to SOCK_DESTROY
+type destroyRequest struct {
+	socket *netlink.Socket
+}
+
+const sizeofDestroyRequest = 56
+
+func (req *destroyRequest) Len() int {
+	return sizeofDestroyRequest
+}
+
+func (req *destroyRequest) Serialize() []byte {
+	id := req.socket.ID
+	b := make([]byte, sizeofDestroyRequest)
+
+	b[0] = req.socket.Family
+	b[1] = unix.IPPROTO_TCP
+	nl.NativeEndian().PutUint32(b[4:8], 0xffffffff)
+	binary.BigEndian.PutUint16(b[8:10], id.SourcePort)
+	binary.BigEndian.PutUint16(b[10:12], id.DestinationPort)
+	if req.socket.Family == unix.AF_INET {
+		copy(b[12:28], id.Source.To4())
+		copy(b[28:44], id.Destination.To4())
+	} else {
+		copy(b[12:28], id.Source.To16())
+		copy(b[28:44], id.Destination.To16())
+	}
+	nl.NativeEndian().PutUint32(b[44:48], id.Interface)
+	nl.NativeEndian().PutUint32(b[48:52], id.Cookie[0])
+	nl.NativeEndian().PutUint32(b[52:56], id.Cookie[1])
+
+	return b
+}
+
+// send SOCK_DESTROY for the socket, the cookie ensures only that socket is
+// closed even if the address and ports have been reused
+func destroySocket(socket *netlink.Socket) error {
+	req := nl.NewNetlinkRequest(nl.SOCK_DESTROY, unix.NLM_F_ACK)
+	req.AddData(&destroyRequest{socket: socket})
+
+	_, err := req.Execute(unix.NETLINK_INET_DIAG, 0)
+
+	return err
+}
@@ -0,0 +1,103 @@
+package firewall
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/gnanderson/xrpl"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+var socketTests = []struct {
+	dst           string
+	sport, dport  int
+	local, remote int
+	match         bool
+}{
+	{"192.0.2.10", 51235, 40000, 51235, 0, true},
+	{"192.0.2.10", 5005, 40000, 51235, 0, false},
+	{"192.0.2.11", 51235, 40000, 51235, 0, false},
+	{"::ffff:192.0.2.10", 51235, 40000, 51235, 0, true},
+	{"192.0.2.10", 40000, 51235, 51235, 51235, true},
+	{"192.0.2.10", 40000, 443, 51235, 51235, false},
+}
+
+func TestSocketMatches(t *testing.T) {
+	ip := net.ParseIP("192.0.2.10")
+
+	for _, tt := range socketTests {
+		socket := &netlink.Socket{ID: netlink.SocketID{
+			SourcePort:      uint16(tt.sport),
+			DestinationPort: uint16(tt.dport),
+			Destination:     net.ParseIP(tt.dst),
+		}}
+
+		if socketMatches(socket, ip, tt.local, tt.remote) != tt.match {
+			t.Errorf("socket to %s:%d from :%d expected match %v", tt.dst, tt.dport, tt.sport, tt.match)
+		}
+	}
+}
+
+func TestNetlinkDestroy(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	nd := NewNetlinkDisconnector(ln.Addr().(*net.TCPAddr).Port)
+	peer := &xrpl.Peer{Address: client.LocalAddr().String(), Inbound: true}
+
+	closed, err := nd.Destroy(peer)
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skip("SOCK_DESTROY unsupported:", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closed != 1 {
+		t.Fatalf("expected the peer's socket to be closed, closed %d", closed)
+	}
+
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the destroyed socket to fail")
+	}
+
+	sockets, err := nd.Sockets(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sockets) != 0 {
+		t.Errorf("expected no sockets left, found %d", len(sockets))
+	}
+}
@@ -0,0 +1,220 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gnanderson/xrpl"
+	"github.com/vishvananda/netns"
+)
+
+// ContainerSockets are the Docker and Podman API sockets a container name is
+// resolved through, in the order they are tried
+var ContainerSockets = []string{
+	"/var/run/docker.sock",
+	"/run/podman/podman.sock",
+}
+
+// NamespaceDisconnector runs a Disconnector, e.g. a NetlinkDisconnector,
+// inside the network namespace of a containerised rippled so its sockets can
+// be closed without the `ss` binary in the image, or `docker exec`. The
+// Namespace is one of
+//
+//   - the PID of a process in the namespace, e.g. rippled or the leader of a
+//     systemd-nspawn machine
+//   - the path of a network namespace, e.g. /run/netns/rippled
+//   - the name or ID of a docker or podman container, resolved to the PID of
+//     the container through the API Socket
+//
+// The namespace is resolved for every disconnect, so a restarted container is
+// followed. Entering the namespace requires root or CAP_SYS_ADMIN.
+type NamespaceDisconnector struct {
+	Namespace string
+	// Socket is the Docker or Podman API socket, if empty the first of
+	// ContainerSockets which exists
+	Socket string
+	Disconnector
+}
+
+// NewNamespaceDisconnector returns a Disconnector running the Disconnector in
+// the network namespace
+func NewNamespaceDisconnector(namespace string, d Disconnector) *NamespaceDisconnector {
+	return &NamespaceDisconnector{Namespace: namespace, Disconnector: d}
+}
+
+// Disconnect closes the peer's sockets inside the network namespace
+func (nd *NamespaceDisconnector) Disconnect(peer *xrpl.Peer) error {
+	return nd.DisconnectContext(context.Background(), peer)
+}
+
+// DisconnectContext closes the peer's sockets inside the network namespace,
+// the context is passed on to the Disconnector if it is a ContextDisconnector
+func (nd *NamespaceDisconnector) DisconnectContext(ctx context.Context, peer *xrpl.Peer) error {
+	path, err := nd.Path()
+	if err != nil {
+		return err
+	}
+
+	return inNamespace(path, func() error {
+		return disconnectContext(ctx, nd.Disconnector, peer)
+	})
+}
+
+// Path resolves the Namespace to the path of the network namespace
+func (nd *NamespaceDisconnector) Path() (string, error) {
+	switch {
+	case nd.Namespace == "":
+		return "", fmt.Errorf("firewall disconnect: no network namespace")
+	case strings.HasPrefix(nd.Namespace, "/"):
+		return nd.Namespace, nil
+	}
+
+	if pid, err := strconv.Atoi(nd.Namespace); err == nil {
+		return pidNamespace(pid), nil
+	}
+
+	socket, err := nd.socket()
+	if err != nil {
+		return "", err
+	}
+
+	pid, err := containerPID(socket, nd.Namespace)
+	if err != nil {
+		return "", err
+	}
+
+	return pidNamespace(pid), nil
+}
+
+// the API socket given, or the first which exists
+func (nd *NamespaceDisconnector) socket() (string, error) {
+	if nd.Socket != "" {
+		return nd.Socket, nil
+	}
+
+	for _, socket := range ContainerSockets {
+		if _, err := os.Stat(socket); err == nil {
+			return socket, nil
+		}
+	}
+	// rootless podman
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		socket := filepath.Join(dir, "podman", "podman.sock")
+		if _, err := os.Stat(socket); err == nil {
+			return socket, nil
+		}
+	}
+
+	return "", fmt.Errorf("firewall disconnect: no docker or podman API socket found for container '%s'", nd.Namespace)
+}
+
+func pidNamespace(pid int) string {
+	return fmt.Sprintf("/proc/%d/ns/net", pid)
+}
+
+// containerPID asks the Docker, or Docker compatible Podman, API for the PID
+// of the container's main process
+func containerPID(socket, container string) (int, error) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://localhost/containers/" + url.PathEscape(container) + "/json")
+	if err != nil {
+		return 0, fmt.Errorf("firewall disconnect: container '%s': %v", container, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("firewall disconnect: container '%s': %s", container, resp.Status)
+	}
+
+	var inspect struct {
+		State struct {
+			Running bool
+			Pid     int
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return 0, fmt.Errorf("firewall disconnect: container '%s': %v", container, err)
+	}
+	if !inspect.State.Running || inspect.State.Pid == 0 {
+		return 0, fmt.Errorf("firewall disconnect: container '%s' is not running", container)
+	}
+
+	return inspect.State.Pid, nil
+}
+
+// inNamespace calls f on an OS thread switched into the network namespace.
+// Sockets opened and commands run by f are in the namespace, f must not start
+// goroutines expecting the same. If the thread cannot be switched back it is
+// left locked, so it exits rather than being reused in the wrong namespace.
+func inNamespace(path string, f func() error) error {
+	target, err := netns.GetFromPath(path)
+	if err != nil {
+		return fmt.Errorf("firewall disconnect: network namespace '%s': %v", path, err)
+	}
+	defer target.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		origin, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			result <- fmt.Errorf("firewall disconnect: current network namespace: %v", err)
+			return
+		}
+		defer origin.Close()
+
+		if err := netns.Set(target); err != nil {
+			runtime.UnlockOSThread()
+			result <- fmt.Errorf("firewall disconnect: enter network namespace '%s': %v", path, err)
+			return
+		}
+
+		result <- f()
+
+		if err := netns.Set(origin); err != nil {
+			log.Println("firewall disconnect: cannot leave network namespace:", err)
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+
+	return <-result
+}
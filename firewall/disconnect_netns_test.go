@@ -0,0 +1,184 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/gnanderson/xrpl"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// fakeContainerAPI serves the docker container inspect endpoint on a unix
+// socket for the containers given, by name and PID
+func fakeContainerAPI(t *testing.T, containers map[string]int) string {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	for name, pid := range containers {
+		pid := pid
+		mux.HandleFunc("/containers/"+name+"/json", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"Id":"abc","State":{"Running":%v,"Pid":%d}}`, pid > 0, pid)
+		})
+	}
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	return socket
+}
+
+func TestNamespacePath(t *testing.T) {
+	socket := fakeContainerAPI(t, map[string]int{"rippled": 1234, "stopped": 0})
+
+	var tests = []struct {
+		namespace, path string
+		err             bool
+	}{
+		{"4321", "/proc/4321/ns/net", false},
+		{"/run/netns/rippled", "/run/netns/rippled", false},
+		{"rippled", "/proc/1234/ns/net", false},
+		{"stopped", "", true},
+		{"missing", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		nd := &NamespaceDisconnector{Namespace: tt.namespace, Socket: socket}
+
+		path, err := nd.Path()
+		if (err != nil) != tt.err {
+			t.Errorf("'%s': unexpected error %v", tt.namespace, err)
+		}
+		if path != tt.path {
+			t.Errorf("'%s': expected '%s' got '%s'", tt.namespace, tt.path, path)
+		}
+	}
+}
+
+// a connected server and client socket in a new network namespace, returned
+// with the path of the namespace
+func namespacedConn(t *testing.T) (string, net.Conn, net.Conn) {
+	t.Helper()
+
+	type conns struct {
+		path           string
+		server, client net.Conn
+		err            error
+		skip           bool
+	}
+
+	result, done := make(chan conns), make(chan struct{})
+	go func() {
+		// the thread is discarded with the namespace
+		runtime.LockOSThread()
+
+		ns, err := netns.New()
+		if err != nil {
+			result <- conns{err: err, skip: true}
+			return
+		}
+		defer ns.Close()
+
+		lo, err := netlink.LinkByName("lo")
+		if err == nil {
+			err = netlink.LinkSetUp(lo)
+		}
+		if err != nil {
+			result <- conns{err: err}
+			return
+		}
+
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			result <- conns{err: err}
+			return
+		}
+		defer ln.Close()
+
+		client, err := net.Dial("tcp4", ln.Addr().String())
+		if err != nil {
+			result <- conns{err: err}
+			return
+		}
+		server, err := ln.Accept()
+		if err != nil {
+			result <- conns{err: err}
+			return
+		}
+
+		path := fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+		result <- conns{path: path, server: server, client: client}
+		// keep the thread, and with it the namespace path, until the test ends
+		<-done
+	}()
+
+	c := <-result
+	if c.skip {
+		t.Skip("cannot create a network namespace:", c.err)
+	}
+	if c.err != nil {
+		t.Fatal(c.err)
+	}
+	t.Cleanup(func() {
+		c.server.Close()
+		c.client.Close()
+		close(done)
+	})
+
+	return c.path, c.server, c.client
+}
+
+func TestNamespaceDisconnect(t *testing.T) {
+	path, server, client := namespacedConn(t)
+
+	port := server.LocalAddr().(*net.TCPAddr).Port
+	peer := &xrpl.Peer{Address: client.LocalAddr().String(), Inbound: true}
+
+	// the socket is not visible from rbh's own namespace
+	sockets, err := NewNetlinkDisconnector(port).Sockets(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sockets) != 0 {
+		t.Fatalf("expected no sockets outside the namespace, found %d", len(sockets))
+	}
+
+	nd := NewNamespaceDisconnector(path, NewChainDisconnector(port, Strategy{Name: "netlink", Disconnector: NewNetlinkDisconnector(port)}))
+	if err := nd.Disconnect(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the destroyed socket to fail")
+	}
+}
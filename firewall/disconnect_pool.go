@@ -0,0 +1,237 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gnanderson/xrpl"
+)
+
+// defaults for a DisconnectPool
+const (
+	DefaultDisconnectWorkers = 4
+	DefaultDisconnectTimeout = 10 * time.Second
+	DefaultDisconnectRetries = 1
+	DefaultDisconnectBackoff = 500 * time.Millisecond
+)
+
+var (
+	errPoolClosed = errors.New("firewall disconnect: pool closed")
+	errPoolFull   = errors.New("firewall disconnect: queue full")
+)
+
+// Outcome is the result of disconnecting a peer in a DisconnectPool
+type Outcome struct {
+	Peer     *xrpl.Peer
+	Attempts int
+	Duration time.Duration
+	Err      error
+}
+
+func (o Outcome) String() string {
+	if o.Err != nil {
+		return fmt.Sprintf("%s failed after %d attempts in %s: %v", o.Peer.Address, o.Attempts, o.Duration, o.Err)
+	}
+
+	return fmt.Sprintf("%s disconnected after %d attempts in %s", o.Peer.Address, o.Attempts, o.Duration)
+}
+
+// DisconnectPool is a Disconnector which queues peers to be disconnected by a
+// bounded number of workers, so a slow Disconnector, e.g. tcpkill, does not
+// hold up banning the next peer. Each attempt is given Timeout to complete,
+// a failed or timed out attempt is retried up to Retries times, waiting
+// Backoff before the first retry and twice as long before each one after.
+// The Outcome of each peer is logged and passed to OnOutcome, if set, from
+// the worker.
+//
+// Once Context, if set, is done failed attempts are no longer retried, so the
+// peers still queued when rbh is stopping are each tried once without delay.
+//
+// The context of an attempt which does not return by the Timeout is cancelled,
+// stopping a ContextDisconnector. Any other Disconnector cannot be stopped, so
+// the worker waits for it to return before retrying, and no more than Workers
+// disconnects ever run at once.
+//
+// The pool is started by the first Disconnect, set its fields before then.
+// Close stops the pool taking peers and waits for those queued to finish.
+type DisconnectPool struct {
+	Disconnector Disconnector
+	Workers      int
+	// Queue is the number of peers which can wait for a worker before
+	// Disconnect returns an error, 16 per worker if zero
+	Queue     int
+	Timeout   time.Duration
+	Retries   int
+	Backoff   time.Duration
+	Context   context.Context
+	OnOutcome func(Outcome)
+
+	once   sync.Once
+	mu     sync.RWMutex
+	jobs   chan *xrpl.Peer
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewDisconnectPool returns a pool disconnecting peers with the Disconnector
+// on the default number of workers, with the default timeout, retries and
+// backoff
+func NewDisconnectPool(d Disconnector) *DisconnectPool {
+	return &DisconnectPool{
+		Disconnector: d,
+		Workers:      DefaultDisconnectWorkers,
+		Timeout:      DefaultDisconnectTimeout,
+		Retries:      DefaultDisconnectRetries,
+		Backoff:      DefaultDisconnectBackoff,
+	}
+}
+
+// Disconnect queues the peer to be disconnected and returns immediately, an
+// error is returned if the queue is full or the pool is closed
+func (dp *DisconnectPool) Disconnect(peer *xrpl.Peer) error {
+	dp.once.Do(dp.start)
+
+	dp.mu.RLock()
+	defer dp.mu.RUnlock()
+
+	if dp.closed {
+		return errPoolClosed
+	}
+
+	select {
+	case dp.jobs <- peer:
+		return nil
+	default:
+		return errPoolFull
+	}
+}
+
+// Close stops the pool taking peers and waits for the queued peers to be
+// disconnected
+func (dp *DisconnectPool) Close() error {
+	dp.once.Do(dp.start)
+
+	dp.mu.Lock()
+	if !dp.closed {
+		dp.closed = true
+		close(dp.jobs)
+	}
+	dp.mu.Unlock()
+
+	dp.wg.Wait()
+
+	return nil
+}
+
+func (dp *DisconnectPool) start() {
+	workers, queue := dp.Workers, dp.Queue
+	if workers < 1 {
+		workers = 1
+	}
+	if queue < 1 {
+		queue = workers * 16
+	}
+
+	dp.jobs = make(chan *xrpl.Peer, queue)
+	for i := 0; i < workers; i++ {
+		dp.wg.Add(1)
+		go dp.work()
+	}
+}
+
+func (dp *DisconnectPool) work() {
+	defer dp.wg.Done()
+
+	for peer := range dp.jobs {
+		outcome := dp.disconnect(peer)
+		log.Println("firewall disconnect:", outcome)
+
+		if dp.OnOutcome != nil {
+			dp.OnOutcome(outcome)
+		}
+	}
+}
+
+// disconnect the peer, retrying failed attempts after a growing backoff
+func (dp *DisconnectPool) disconnect(peer *xrpl.Peer) Outcome {
+	outcome := Outcome{Peer: peer}
+	start := time.Now()
+	backoff := dp.Backoff
+
+	for outcome.Attempts <= dp.Retries {
+		if outcome.Attempts > 0 && !sleepContext(dp.context(), backoff) {
+			break
+		}
+		backoff *= 2
+
+		outcome.Attempts++
+		if outcome.Err = dp.attempt(peer); outcome.Err == nil {
+			break
+		}
+	}
+	outcome.Duration = time.Since(start)
+
+	return outcome
+}
+
+// a single attempt, cancelled after the timeout
+func (dp *DisconnectPool) attempt(peer *xrpl.Peer) error {
+	if dp.Timeout <= 0 {
+		return dp.Disconnector.Disconnect(peer)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dp.Timeout)
+	defer cancel()
+
+	err := disconnectContext(ctx, dp.Disconnector, peer)
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("timed out after %s", dp.Timeout)
+	}
+
+	return err
+}
+
+func (dp *DisconnectPool) context() context.Context {
+	if dp.Context == nil {
+		return context.Background()
+	}
+
+	return dp.Context
+}
+
+// sleepContext waits for d, it returns false if the context is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,275 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gnanderson/xrpl"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// collect the outcomes reported by a pool
+type outcomes struct {
+	sync.Mutex
+	list []Outcome
+}
+
+func (o *outcomes) add(outcome Outcome) {
+	o.Lock()
+	defer o.Unlock()
+	o.list = append(o.list, outcome)
+}
+
+func TestPoolDisconnectsConcurrently(t *testing.T) {
+	var running, most int32
+	slow := disconnectFunc(func(peer *xrpl.Peer) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+
+	got := &outcomes{}
+	dp := NewDisconnectPool(slow)
+	dp.Workers = 3
+	dp.OnOutcome = got.add
+
+	start := time.Now()
+	for i := 0; i < 9; i++ {
+		if err := dp.Disconnect(&xrpl.Peer{Address: "192.0.2." + strconv.Itoa(i) + ":51235"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if time.Since(start) > 40*time.Millisecond {
+		t.Error("expected Disconnect not to wait for the disconnect")
+	}
+
+	dp.Close()
+
+	if len(got.list) != 9 {
+		t.Fatalf("expected every queued peer to be disconnected before Close returns, got %d", len(got.list))
+	}
+	if most > 3 {
+		t.Errorf("expected at most 3 disconnects at once, got %d", most)
+	}
+	for _, outcome := range got.list {
+		if outcome.Err != nil || outcome.Attempts != 1 {
+			t.Errorf("unexpected outcome %s", outcome)
+		}
+	}
+
+	if err := dp.Disconnect(&xrpl.Peer{Address: "192.0.2.10:51235"}); err != errPoolClosed {
+		t.Errorf("expected the closed pool to refuse peers, got %v", err)
+	}
+}
+
+// contextFunc is a ContextDisconnector
+type contextFunc func(ctx context.Context, peer *xrpl.Peer) error
+
+func (f contextFunc) Disconnect(peer *xrpl.Peer) error {
+	return f(context.Background(), peer)
+}
+
+func (f contextFunc) DisconnectContext(ctx context.Context, peer *xrpl.Peer) error {
+	return f(ctx, peer)
+}
+
+func TestPoolRetriesAndTimesOut(t *testing.T) {
+	var calls int32
+	flaky := contextFunc(func(ctx context.Context, peer *xrpl.Peer) error {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			return errors.New("unsupported")
+		case 2:
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+
+	got := &outcomes{}
+	dp := NewDisconnectPool(flaky)
+	dp.Workers = 1
+	dp.Timeout = 50 * time.Millisecond
+	dp.Retries = 2
+	dp.Backoff = time.Millisecond
+	dp.OnOutcome = got.add
+
+	dp.Disconnect(&xrpl.Peer{Address: "192.0.2.10:51235"})
+	dp.Close()
+
+	if len(got.list) != 1 {
+		t.Fatalf("expected one outcome, got %d", len(got.list))
+	}
+	if outcome := got.list[0]; outcome.Err != nil || outcome.Attempts != 3 {
+		t.Errorf("expected success on the third attempt, got %s", outcome)
+	}
+
+	got.list = nil
+	dp = NewDisconnectPool(disconnectFunc(func(peer *xrpl.Peer) error { return errors.New("unsupported") }))
+	dp.Retries = 1
+	dp.Backoff = time.Millisecond
+	dp.OnOutcome = got.add
+
+	dp.Disconnect(&xrpl.Peer{Address: "192.0.2.10:51235"})
+	dp.Close()
+
+	if outcome := got.list[0]; outcome.Err == nil || outcome.Attempts != 2 {
+		t.Errorf("expected failure after two attempts, got %s", outcome)
+	}
+}
+
+func TestPoolWaitsForTimedOutAttempt(t *testing.T) {
+	var running, most int32
+	slow := disconnectFunc(func(peer *xrpl.Peer) error {
+		if n := atomic.AddInt32(&running, 1); n > atomic.LoadInt32(&most) {
+			atomic.StoreInt32(&most, n)
+		}
+		defer atomic.AddInt32(&running, -1)
+		time.Sleep(100 * time.Millisecond)
+		return errors.New("unsupported")
+	})
+
+	got := &outcomes{}
+	dp := NewDisconnectPool(slow)
+	dp.Workers = 1
+	dp.Timeout = 20 * time.Millisecond
+	dp.Retries = 2
+	dp.Backoff = time.Millisecond
+	dp.OnOutcome = got.add
+
+	dp.Disconnect(&xrpl.Peer{Address: "192.0.2.10:51235"})
+	dp.Disconnect(&xrpl.Peer{Address: "192.0.2.11:51235"})
+	dp.Close()
+
+	// the Disconnector cannot be stopped, so it is not retried or given the
+	// next peer until it returns
+	if most != 1 {
+		t.Errorf("expected one disconnect at a time, got %d", most)
+	}
+	for _, outcome := range got.list {
+		if outcome.Attempts != 3 || !strings.Contains(outcome.Err.Error(), "timed out") {
+			t.Errorf("expected three timed out attempts, got %s", outcome)
+		}
+	}
+}
+
+func TestPoolBacksOff(t *testing.T) {
+	var attempts []time.Time
+	failing := disconnectFunc(func(peer *xrpl.Peer) error {
+		attempts = append(attempts, time.Now())
+		return errors.New("unsupported")
+	})
+
+	dp := NewDisconnectPool(failing)
+	dp.Workers = 1
+	dp.Retries = 2
+	dp.Backoff = 20 * time.Millisecond
+
+	dp.Disconnect(&xrpl.Peer{Address: "192.0.2.10:51235"})
+	dp.Close()
+
+	if len(attempts) != 3 {
+		t.Fatalf("expected three attempts, got %d", len(attempts))
+	}
+	for i, want := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond} {
+		if gap := attempts[i+1].Sub(attempts[i]); gap < want {
+			t.Errorf("expected at least %s before retry %d, got %s", want, i+1, gap)
+		}
+	}
+}
+
+func TestPoolBackoffStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int32
+	failing := disconnectFunc(func(peer *xrpl.Peer) error {
+		atomic.AddInt32(&calls, 1)
+		cancel()
+		return errors.New("unsupported")
+	})
+
+	got := &outcomes{}
+	dp := NewDisconnectPool(failing)
+	dp.Workers = 1
+	dp.Retries = 3
+	dp.Backoff = time.Hour
+	dp.Context = ctx
+	dp.OnOutcome = got.add
+
+	dp.Disconnect(&xrpl.Peer{Address: "192.0.2.10:51235"})
+	dp.Disconnect(&xrpl.Peer{Address: "192.0.2.11:51235"})
+	dp.Close()
+
+	// each peer is still tried once, but not retried
+	if calls != 2 {
+		t.Errorf("expected one attempt for each peer, got %d", calls)
+	}
+	if len(got.list) != 2 {
+		t.Fatalf("expected two outcomes, got %d", len(got.list))
+	}
+	for _, outcome := range got.list {
+		if outcome.Attempts != 1 || outcome.Err == nil {
+			t.Errorf("expected the retries to be abandoned, got %s", outcome)
+		}
+	}
+}
+
+func TestPoolQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	dp := NewDisconnectPool(disconnectFunc(func(peer *xrpl.Peer) error {
+		<-block
+		return nil
+	}))
+	dp.Workers, dp.Queue, dp.Timeout = 1, 1, 0
+
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = dp.Disconnect(&xrpl.Peer{Address: "192.0.2.10:51235"})
+	}
+	if err != errPoolFull {
+		t.Errorf("expected the queue to fill, got %v", err)
+	}
+
+	close(block)
+	dp.Close()
+}
+
+func TestFirewallCloseDrainsPool(t *testing.T) {
+	fw, _ := newTestFirewall(10)
+	nd := fw.Disconnector.(*nopDisconnector)
+	fw.Disconnector = NewDisconnectPool(nd)
+
+	fw.BanPeer(&xrpl.Peer{Address: "192.0.2.10:51235", PublicKey: "a"})
+	fw.Close()
+
+	if len(nd.peers) != 1 {
+		t.Errorf("expected the peer to be disconnected on close, got %d", len(nd.peers))
+	}
+}
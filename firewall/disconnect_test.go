@@ -0,0 +1,104 @@
+package firewall
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gnanderson/xrpl"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+var tcpkillTests = []struct {
+	tcp  TCPKillDisconnector
+	peer xrpl.Peer
+	args string
+	err  bool
+}{
+	{
+		TCPKillDisconnector{Aggression: 3, Interface: "eth0"},
+		xrpl.Peer{Address: "192.0.2.10:40000", Inbound: true},
+		"-i eth0 -3 host 192.0.2.10 and port 51235",
+		false,
+	},
+	{
+		TCPKillDisconnector{Aggression: 9, Interface: "eth0", Port: 2459},
+		xrpl.Peer{Address: "[2001:db8::10]:40000", Inbound: true},
+		"-i eth0 -9 host 2001:db8::10 and port 2459",
+		false,
+	},
+	{
+		TCPKillDisconnector{Aggression: 3, Interface: "eth0"},
+		xrpl.Peer{Address: "192.0.2.10:51235"},
+		"-i eth0 -3 host 192.0.2.10 and port 51235",
+		false,
+	},
+	{
+		TCPKillDisconnector{Aggression: 3, Interface: "eth0"},
+		xrpl.Peer{Address: "192.0.2.10:2459"},
+		"-i eth0 -3 host 192.0.2.10 and (port 51235 or port 2459)",
+		false,
+	},
+	{
+		TCPKillDisconnector{Aggression: 3, Interface: "eth0", PortOnly: true},
+		xrpl.Peer{Address: "192.0.2.10:2459"},
+		"-i eth0 -3 host 192.0.2.10 and port 51235",
+		false,
+	},
+	{
+		TCPKillDisconnector{Aggression: 3, Docker: true, Container: "rippled"},
+		xrpl.Peer{Address: "192.0.2.10:40000", Inbound: true},
+		"-3 host 192.0.2.10 and port 51235",
+		false,
+	},
+	{
+		TCPKillDisconnector{Aggression: 10, Interface: "eth0"},
+		xrpl.Peer{Address: "192.0.2.10:40000", Inbound: true},
+		"",
+		true,
+	},
+	{
+		TCPKillDisconnector{Aggression: 3, Interface: "eth0"},
+		xrpl.Peer{Address: "invalid"},
+		"",
+		true,
+	},
+}
+
+func TestTCPKillArgs(t *testing.T) {
+	for _, tt := range tcpkillTests {
+		args, err := tt.tcp.args(&tt.peer)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.peer.Address, err)
+			continue
+		}
+		if got := strings.Join(args, " "); got != tt.args {
+			t.Errorf("%s: expected args '%s' got '%s'", tt.peer.Address, tt.args, got)
+		}
+	}
+}
+
+func TestRouteInterface(t *testing.T) {
+	iface, err := routeInterface(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Skip("no route lookup:", err)
+	}
+	if iface != "lo" {
+		t.Errorf("expected the loopback interface, got '%s'", iface)
+	}
+}
@@ -0,0 +1,670 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gnanderson/xrpl"
+)
+
+// Backend is the enforcement layer a Firewall delegates bans to, e.g.
+// firewalld. Implementations must be safe to call repeatedly for the same ban.
+type Backend interface {
+	// Ban applies the ban, it should be a no-op if the ban is already in place
+	Ban(ban *Ban) error
+	// Unban lifts a ban applied previously
+	Unban(ban *Ban) error
+	// List returns the bans the backend currently has in place
+	List() ([]*Ban, error)
+	// Reconcile re-applies bans that may have been lost, e.g. after the
+	// firewall has been reloaded by the sysadmin
+	Reconcile(bans []*Ban) error
+	// Health returns an error if the backend is not available for use
+	Health() error
+}
+
+// Watcher is implemented by backends which know when their bans have been
+// lost, e.g. firewalld is reloaded or restarted
+type Watcher interface {
+	// Watch calls refresh whenever the bans need to be re-applied, until the
+	// context is done
+	Watch(ctx context.Context, refresh func())
+}
+
+// Ban is a banned source, either a single address or a network, and when the
+// ban expires
+type Ban struct {
+	IP net.IP
+	// Prefix is the length of the banned network, zero bans the single
+	// address i.e. a /32 or /128
+	Prefix  int
+	Expires time.Time
+	// Reason the source was banned, it is logged by backends which support
+	// it, see Reason
+	Reason string
+}
+
+// NewBan creates a ban for the IP lasting the given duration from now
+func NewBan(ip net.IP, duration time.Duration) *Ban {
+	return &Ban{IP: ip, Expires: time.Now().Add(duration)}
+}
+
+// NewNetBan creates a ban for the network lasting the given duration from now
+func NewNetBan(network *net.IPNet, duration time.Duration) *Ban {
+	ones, _ := network.Mask.Size()
+	return &Ban{IP: network.IP, Prefix: ones, Expires: time.Now().Add(duration)}
+}
+
+// the address length in bits
+func addrBits(ip net.IP) int {
+	if ip.To4() != nil {
+		return 8 * net.IPv4len
+	}
+
+	return 8 * net.IPv6len
+}
+
+// Net returns the banned network, a single address is a /32 or /128
+func (b *Ban) Net() *net.IPNet {
+	IP := b.IP
+	if ip4 := IP.To4(); ip4 != nil {
+		IP = ip4
+	}
+
+	bits := addrBits(IP)
+	prefix := b.Prefix
+	if prefix <= 0 || prefix > bits {
+		prefix = bits
+	}
+
+	mask := net.CIDRMask(prefix, bits)
+	return &net.IPNet{IP: IP.Mask(mask), Mask: mask}
+}
+
+// CIDR returns the banned network in CIDR notation, e.g. 192.0.2.1/32
+func (b *Ban) CIDR() string {
+	return b.Net().String()
+}
+
+// Timeout returns the time remaining on the ban to the nearest second, or zero
+// if the expiry is unknown or has passed
+func (b *Ban) Timeout() time.Duration {
+	if b.Expires.IsZero() {
+		return 0
+	}
+
+	if remaining := time.Until(b.Expires); remaining > 0 {
+		return remaining.Round(time.Second)
+	}
+
+	return 0
+}
+
+func (b *Ban) String() string {
+	return fmt.Sprintf("%s (%s)", b.CIDR(), b.Timeout())
+}
+
+type blEntry struct {
+	peer    *xrpl.Peer
+	expires time.Time
+	reason  string
+	// network is set for entries restored from the backend, the ban is for
+	// exactly this network rather than one derived from the peer address
+	network *net.IPNet
+}
+
+func (ble *blEntry) expired() bool {
+	return ble.expires.Sub(time.Now()) < 0
+}
+
+// peerIP returns the IP address of the peer or nil, unlike Peer.IP it does not
+// exit if the address cannot be parsed
+func peerIP(peer *xrpl.Peer) net.IP {
+	host, _, err := net.SplitHostPort(peer.Address)
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// parseSource parses an IP address or CIDR network as a network, a single
+// address is a /32 or /128
+func parseSource(source string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(source); err == nil {
+		return network, nil
+	}
+
+	IP := net.ParseIP(source)
+	if IP == nil {
+		return nil, fmt.Errorf("firewall: invalid source address '%s'", source)
+	}
+
+	return (&Ban{IP: IP}).Net(), nil
+}
+
+type blacklist struct {
+	sync.Mutex
+	entries   map[string]*blEntry
+	duration  time.Duration
+	prefix4   int
+	prefix6   int
+	whitelist *whitelist
+	// expired bans the backend could not lift while it was down
+	unbans []*Ban
+}
+
+// the ban for an entry, aggregated to the configured prefix unless that would
+// cover a whitelisted address
+func (bl *blacklist) ban(entry *blEntry) *Ban {
+	if entry.network != nil {
+		ban := NewNetBan(entry.network, 0)
+		ban.Expires = entry.expires
+		ban.Reason = entry.reason
+		return ban
+	}
+
+	ban := &Ban{IP: peerIP(entry.peer), Expires: entry.expires, Reason: entry.reason}
+	if ban.IP == nil {
+		return ban
+	}
+
+	if ban.IP.To4() != nil {
+		ban.Prefix = bl.prefix4
+	} else {
+		ban.Prefix = bl.prefix6
+	}
+
+	if ban.Prefix > 0 && bl.whitelist != nil && bl.whitelist.overlaps(ban.Net()) {
+		ban.Prefix = 0
+	}
+
+	return ban
+}
+
+func (bl *blacklist) add(peer *xrpl.Peer, reason string) {
+	bl.addFor(peer, reason, 0)
+}
+
+// addFor adds the peer for the length given, the blacklist's duration if zero
+func (bl *blacklist) addFor(peer *xrpl.Peer, reason string, length time.Duration) {
+	bl.Lock()
+	defer bl.Unlock()
+
+	if length <= 0 {
+		length = bl.duration
+	}
+
+	newEntry := &blEntry{
+		peer:    peer,
+		expires: time.Now().Add(length),
+		reason:  reason,
+	}
+
+	if _, ok := bl.entries[peer.PublicKey]; !ok {
+		bl.entries[peer.PublicKey] = newEntry
+	}
+}
+
+func (bl *blacklist) contains(peer *xrpl.Peer) bool {
+	bl.Lock()
+	defer bl.Unlock()
+
+	if _, ok := bl.entries[peer.PublicKey]; ok {
+		return true
+	}
+	return false
+}
+
+// expireEntries removes expired entries returning their bans, along with the
+// bans queued by retry
+func (bl *blacklist) expireEntries() []*Ban {
+	bl.Lock()
+	defer bl.Unlock()
+
+	expired := bl.unbans
+	bl.unbans = nil
+	for _, entry := range bl.entries {
+		if entry.expired() {
+			delete(bl.entries, entry.peer.PublicKey)
+			if ban := bl.ban(entry); ban.IP != nil {
+				expired = append(expired, ban)
+			}
+		}
+	}
+
+	return expired
+}
+
+// retry queues bans to be lifted again the next time entries are expired
+func (bl *blacklist) retry(bans []*Ban) {
+	bl.Lock()
+	defer bl.Unlock()
+
+	bl.unbans = append(bl.unbans, bans...)
+}
+
+// remove deletes the entries matching, returning them along with their bans
+func (bl *blacklist) remove(match func(entry *blEntry, ban *Ban) bool) ([]*blEntry, []*Ban) {
+	bl.Lock()
+	defer bl.Unlock()
+
+	removed := make([]*blEntry, 0)
+	bans := make([]*Ban, 0)
+	for key, entry := range bl.entries {
+		ban := bl.ban(entry)
+		if match(entry, ban) {
+			delete(bl.entries, key)
+			removed = append(removed, entry)
+			bans = append(bans, ban)
+		}
+	}
+
+	return removed, bans
+}
+
+// bans returns a snapshot of the blacklist as backend bans
+func (bl *blacklist) bans() []*Ban {
+	bl.Lock()
+	defer bl.Unlock()
+
+	bans := make([]*Ban, 0, len(bl.entries))
+	for _, entry := range bl.entries {
+		if ban := bl.ban(entry); ban.IP != nil {
+			bans = append(bans, ban)
+		}
+	}
+
+	return bans
+}
+
+type whitelist struct {
+	sync.Mutex
+	entries map[string]*xrpl.Peer
+}
+
+func (wl *whitelist) add(ip string) {
+	wl.Lock()
+	defer wl.Unlock()
+
+	if _, ok := wl.entries[ip]; !ok {
+		wl.entries[ip] = nil
+	}
+}
+
+// overlaps returns true if any whitelisted address is within the network
+func (wl *whitelist) overlaps(network *net.IPNet) bool {
+	wl.Lock()
+	defer wl.Unlock()
+
+	for entry := range wl.entries {
+		if IP := net.ParseIP(entry); IP != nil && network.Contains(IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (wl *whitelist) contains(peer *xrpl.Peer) bool {
+	wl.Lock()
+	defer wl.Unlock()
+
+	if _, ok := wl.entries[peer.IP().String()]; ok {
+		// always update the peer data with current known state
+		wl.entries[peer.IP().String()] = peer
+		return true
+	}
+	return false
+}
+
+// Firewall provides functionality for temporarily banning XRPL peer nodes, the
+// bans themselves are enforced by the configured Backend
+type Firewall struct {
+	Backend      Backend
+	Disconnector Disconnector
+	// StateFile is where the blacklist is saved so it can be restored with
+	// the remaining ban times after a restart, see Restore
+	StateFile string
+	whitelist *whitelist
+	blacklist *blacklist
+	pardons   *pardons
+}
+
+// pardons are peers and networks unbanned early, they are not banned again
+// until the pardon expires
+type pardons struct {
+	sync.Mutex
+	peers    map[string]time.Time
+	networks map[string]time.Time
+}
+
+func (pd *pardons) add(duration time.Duration, publicKeys []string, networks []*net.IPNet) {
+	pd.Lock()
+	defer pd.Unlock()
+
+	expires := time.Now().Add(duration)
+	for _, key := range publicKeys {
+		pd.peers[key] = expires
+	}
+	for _, network := range networks {
+		pd.networks[network.String()] = expires
+	}
+}
+
+func (pd *pardons) contains(peer *xrpl.Peer) bool {
+	pd.Lock()
+	defer pd.Unlock()
+
+	now := time.Now()
+	for key, expires := range pd.peers {
+		if now.After(expires) {
+			delete(pd.peers, key)
+		}
+	}
+	for cidr, expires := range pd.networks {
+		if now.After(expires) {
+			delete(pd.networks, cidr)
+		}
+	}
+
+	if _, ok := pd.peers[peer.PublicKey]; ok {
+		return true
+	}
+
+	IP := peerIP(peer)
+	for cidr := range pd.networks {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && IP != nil && network.Contains(IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewFirewall instantiates a Firewall ready for use with XRPL peer nodes. Set
+// the Backend before use, e.g. one returned by NewFirewalldBackend, until then
+// bans are only blacklisted.
+func NewFirewall(banLength int, whiteList ...string) *Firewall {
+	wl := &whitelist{entries: make(map[string]*xrpl.Peer)}
+	fw := &Firewall{
+		Backend:      &FirewalldBackend{},
+		Disconnector: DefaultDisconnector,
+		whitelist:    wl,
+		blacklist: &blacklist{
+			entries:   make(map[string]*blEntry),
+			duration:  time.Duration(banLength) * time.Minute,
+			whitelist: wl,
+		},
+		pardons: &pardons{
+			peers:    make(map[string]time.Time),
+			networks: make(map[string]time.Time),
+		},
+	}
+
+	for _, entry := range whiteList {
+		fw.whitelist.add(entry)
+	}
+
+	return fw
+}
+
+// Aggregate bans peers by network rather than by address, e.g. 24 bans the
+// IPv4 /24 and 64 the IPv6 /64 a peer is in so an operator rotating through
+// addresses is banned as one unit. Zero bans single addresses, the default.
+// Networks containing a whitelisted address are never aggregated.
+func (fw *Firewall) Aggregate(prefix4, prefix6 int) error {
+	if prefix4 < 0 || prefix4 > 32 {
+		return fmt.Errorf("firewall: invalid IPv4 prefix length '%d'", prefix4)
+	}
+	if prefix6 < 0 || prefix6 > 128 {
+		return fmt.Errorf("firewall: invalid IPv6 prefix length '%d'", prefix6)
+	}
+
+	fw.blacklist.Lock()
+	defer fw.blacklist.Unlock()
+
+	fw.blacklist.prefix4 = prefix4
+	fw.blacklist.prefix6 = prefix6
+
+	return nil
+}
+
+// the ban for a peer, aggregated unless that would cover a whitelisted address
+func (fw *Firewall) peerBan(peer *xrpl.Peer, reason string, length time.Duration) *Ban {
+	fw.blacklist.Lock()
+	defer fw.blacklist.Unlock()
+
+	if length <= 0 {
+		length = fw.blacklist.duration
+	}
+
+	return fw.blacklist.ban(&blEntry{
+		peer:    peer,
+		expires: time.Now().Add(length),
+		reason:  reason,
+	})
+}
+
+// Up returns true if the firewall backend is available to use
+func (fw *Firewall) Up() bool {
+	return fw.Backend.Health() == nil
+}
+
+// Watch re-applies the blacklist whenever the backend loses its bans, until the
+// context is done. It returns false if the backend is not a Watcher, the bans
+// then need to be refreshed some other way, e.g. periodically.
+func (fw *Firewall) Watch(ctx context.Context) bool {
+	watcher, ok := fw.Backend.(Watcher)
+	if ok {
+		watcher.Watch(ctx, fw.RefreshBans)
+	}
+
+	return ok
+}
+
+// Close waits for queued disconnects, e.g. in a DisconnectPool, then releases
+// the backend's resources, e.g. its connection to firewalld
+func (fw *Firewall) Close() error {
+	if closer, ok := fw.Disconnector.(io.Closer); ok {
+		closer.Close()
+	}
+
+	if closer, ok := fw.Backend.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// BanPeer bans the XRPL peer through the backend, and adds it to a blacklist
+// so we can track the expiration and re-apply on firewall reload. IP's that
+// are in the whitelist are ignored, as are peers recently unbanned with
+// UnbanPeer. If the backend is down the peer is still blacklisted and the ban
+// is applied by RefreshBans once it is back. The reason for the ban is the
+// stability check the peer failed, see Reason.
+func (fw *Firewall) BanPeer(peer *xrpl.Peer) {
+	fw.BanPeerFor(peer, Reason(peer))
+}
+
+// BanPeerFor bans the XRPL peer exactly as BanPeer does, giving the reason for
+// the ban
+func (fw *Firewall) BanPeerFor(peer *xrpl.Peer, reason string) {
+	fw.BanPeerForLength(peer, reason, 0)
+}
+
+// BanPeerForLength bans the XRPL peer exactly as BanPeerFor does, for the
+// length given rather than the firewall's ban length if it is not zero, e.g.
+// the ban length of a policy Rule
+func (fw *Firewall) BanPeerForLength(peer *xrpl.Peer, reason string, length time.Duration) {
+	if fw.whitelist.contains(peer) || fw.pardons.contains(peer) {
+		return
+	}
+
+	ban := fw.peerBan(peer, reason, length)
+	if ban.IP == nil {
+		log.Println("firewall: invalid IP address for peer", peer.PublicKey)
+		return
+	}
+
+	if !fw.Up() {
+		log.Println("firewall: backend down, queueing ban", ban)
+	} else if err := fw.Backend.Ban(ban); err != nil {
+		log.Println(err)
+	}
+
+	fw.blacklist.addFor(peer, reason, length)
+	fw.saveState()
+
+	fw.Disconnect(peer)
+}
+
+// BanNetwork bans every address in the network through the backend and
+// disconnects any of the peers given that are within it. The network is not
+// added to the blacklist so the ban is left to the backend to expire.
+func (fw *Firewall) BanNetwork(network *net.IPNet, peers ...*xrpl.Peer) error {
+	if fw.whitelist.overlaps(network) {
+		return fmt.Errorf("firewall: network %s contains a whitelisted address", network)
+	}
+
+	ban := NewNetBan(network, fw.blacklist.duration)
+	ban.Reason = ReasonManual
+	if err := fw.Backend.Ban(ban); err != nil {
+		return err
+	}
+
+	for _, peer := range peers {
+		if IP := peerIP(peer); IP != nil && network.Contains(IP) {
+			fw.Disconnect(peer)
+		}
+	}
+
+	return nil
+}
+
+// UnbanPeer lifts bans early, the target is a peer's public key, an IP address
+// or a CIDR network. Blacklisted peers matching the target are removed from the
+// blacklist and their bans lifted in the backend, as is the address or network
+// itself. Other peers sharing a lifted network are unbanned with it. Everything
+// unbanned is pardoned for the ban length so it is not banned again straight
+// away. The bans lifted are returned.
+func (fw *Firewall) UnbanPeer(target string) ([]*Ban, error) {
+	network, _ := parseSource(target)
+
+	entries, bans := fw.blacklist.remove(func(entry *blEntry, ban *Ban) bool {
+		if network == nil {
+			return entry.peer.PublicKey == target
+		}
+		return ban.IP != nil && network.Contains(ban.IP)
+	})
+
+	lifted := make(map[string]*Ban)
+	for _, ban := range bans {
+		lifted[ban.CIDR()] = ban
+	}
+
+	shared, _ := fw.blacklist.remove(func(entry *blEntry, ban *Ban) bool {
+		_, ok := lifted[ban.CIDR()]
+		return ok
+	})
+	entries = append(entries, shared...)
+
+	networks := make([]*net.IPNet, 0, len(lifted)+1)
+	if network != nil {
+		ban := NewNetBan(network, 0)
+		lifted[ban.CIDR()] = ban
+	}
+	if len(lifted) == 0 {
+		return nil, fmt.Errorf("firewall: no ban found for '%s'", target)
+	}
+
+	publicKeys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		publicKeys = append(publicKeys, entry.peer.PublicKey)
+	}
+
+	var err error
+	unbanned := make([]*Ban, 0, len(lifted))
+	for _, ban := range lifted {
+		networks = append(networks, ban.Net())
+		if unbanErr := fw.Backend.Unban(ban); unbanErr != nil {
+			log.Println(unbanErr)
+			err = unbanErr
+			continue
+		}
+		unbanned = append(unbanned, ban)
+	}
+
+	fw.pardons.add(fw.blacklist.duration, publicKeys, networks)
+	fw.saveState()
+
+	return unbanned, err
+}
+
+// Expire will traverse the blacklist and remove any XRPL peers which have
+// exceeded their ban length. The ban is lifted in the backend too, for backends
+// that can't time out a ban themselves, e.g. firewalld ipsets, unless another
+// banned peer shares the aggregated network. Bans which cannot be lifted while
+// the backend is down are retried on the next Expire.
+func (fw *Firewall) Expire() {
+	expired := fw.blacklist.expireEntries()
+	if len(expired) == 0 {
+		return
+	}
+	defer fw.saveState()
+
+	active := make(map[string]bool)
+	for _, ban := range fw.blacklist.bans() {
+		active[ban.CIDR()] = true
+	}
+
+	failed := make([]*Ban, 0)
+	for _, ban := range expired {
+		if active[ban.CIDR()] {
+			continue
+		}
+		if err := fw.Backend.Unban(ban); err != nil {
+			log.Println(err)
+			if !fw.Up() {
+				failed = append(failed, ban)
+			}
+		}
+	}
+	fw.blacklist.retry(failed)
+}
+
+// RefreshBans re-applies the bans for unstable peers, this is used after the
+// firewall reload notify signal.
+func (fw *Firewall) RefreshBans() {
+	fw.Expire()
+	if err := fw.Backend.Reconcile(fw.blacklist.bans()); err != nil {
+		log.Println(err)
+	}
+}
+
+// Disconnect a peer socket
+func (fw *Firewall) Disconnect(peer *xrpl.Peer) {
+	if err := fw.Disconnector.Disconnect(peer); err != nil {
+		log.Println("firewall disconnect:", err)
+	}
+}
@@ -0,0 +1,446 @@
+package firewall
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gnanderson/xrpl"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+type nopDisconnector struct {
+	peers []*xrpl.Peer
+}
+
+func (nd *nopDisconnector) Disconnect(peer *xrpl.Peer) error {
+	nd.peers = append(nd.peers, peer)
+	return nil
+}
+
+func newTestFirewall(banLength int) (*Firewall, *MemoryBackend) {
+	mb := NewMemoryBackend("drop")
+	fw := NewFirewall(banLength)
+	fw.Backend = mb
+	fw.Disconnector = &nopDisconnector{}
+
+	return fw, mb
+}
+
+var banTests = []struct {
+	addr, ip string
+}{
+	{"192.0.2.10:51235", "192.0.2.10"},
+	{"[2001:db8::10]:51235", "2001:db8::10"},
+}
+
+func TestBanPeerAppliesRule(t *testing.T) {
+	fw, mb := newTestFirewall(10)
+
+	for i, tt := range banTests {
+		fw.BanPeer(&xrpl.Peer{Address: tt.addr, PublicKey: tt.ip})
+
+		history := mb.History()
+		if len(history) != i+1 {
+			t.Fatalf("unexpected number of rules applied '%d'", len(history))
+		}
+
+		rule := history[i]
+		if rule.Op != MemoryBan || rule.Zone != "drop" || rule.Ban.IP.String() != tt.ip {
+			t.Errorf("unexpected rule for %s: %+v", tt.ip, rule)
+		}
+		if rule.Timeout != 10*time.Minute {
+			t.Errorf("unexpected timeout for %s: %s", tt.ip, rule.Timeout)
+		}
+	}
+
+	if len(fw.Disconnector.(*nopDisconnector).peers) != len(banTests) {
+		t.Fatal("banned peers were not disconnected")
+	}
+}
+
+func TestRefreshBansReappliesRules(t *testing.T) {
+	fw, mb := newTestFirewall(10)
+
+	for _, tt := range banTests {
+		fw.BanPeer(&xrpl.Peer{Address: tt.addr, PublicKey: tt.ip})
+	}
+
+	// a firewall reload loses the rules
+	mb.Reset()
+	fw.RefreshBans()
+
+	rules := mb.Rules()
+	if len(rules) != len(banTests) {
+		t.Fatalf("unexpected number of rules '%d'", len(rules))
+	}
+
+	for _, rule := range rules {
+		if rule.Op != MemoryReconcile {
+			t.Errorf("unexpected op for %s: %s", rule.Ban.IP, rule.Op)
+		}
+		if rule.Timeout > 10*time.Minute || rule.Timeout < 9*time.Minute {
+			t.Errorf("unexpected timeout for %s: %s", rule.Ban.IP, rule.Timeout)
+		}
+	}
+}
+
+func TestExpireLiftsBans(t *testing.T) {
+	fw, mb := newTestFirewall(10)
+
+	fw.BanPeer(&xrpl.Peer{Address: banTests[0].addr, PublicKey: banTests[0].ip})
+
+	fw.blacklist.entries[banTests[0].ip].expires = time.Now().Add(-time.Second)
+	fw.Expire()
+
+	if len(fw.blacklist.entries) != 0 {
+		t.Fatalf("unexpected number of blacklist entries '%d'", len(fw.blacklist.entries))
+	}
+
+	history := mb.History()
+	last := history[len(history)-1]
+	if last.Op != MemoryUnban || last.Ban.IP.String() != banTests[0].ip {
+		t.Fatalf("expected ban to be lifted, got %+v", last)
+	}
+	if len(mb.Rules()) != 0 {
+		t.Fatalf("unexpected number of rules '%d'", len(mb.Rules()))
+	}
+}
+
+func TestBanQueuedWhileDown(t *testing.T) {
+	fw, mb := newTestFirewall(10)
+	mb.SetHealth(errNotRunning)
+
+	fw.BanPeer(&xrpl.Peer{Address: banTests[0].addr, PublicKey: banTests[0].ip})
+
+	if len(mb.History()) != 0 {
+		t.Fatalf("unexpected rules applied while down: %+v", mb.History())
+	}
+	if !fw.blacklist.contains(&xrpl.Peer{PublicKey: banTests[0].ip}) {
+		t.Fatal("expected the peer to be blacklisted while down")
+	}
+
+	mb.SetHealth(nil)
+	fw.RefreshBans()
+
+	rules := mb.Rules()
+	if len(rules) != 1 || rules[0].Ban.IP.String() != banTests[0].ip {
+		t.Fatalf("expected the queued ban to be applied, got %+v", rules)
+	}
+}
+
+func TestExpireRetriedWhileDown(t *testing.T) {
+	fw, mb := newTestFirewall(10)
+
+	fw.BanPeer(&xrpl.Peer{Address: banTests[0].addr, PublicKey: banTests[0].ip})
+
+	fw.blacklist.entries[banTests[0].ip].expires = time.Now().Add(-time.Second)
+	mb.SetHealth(errNotRunning)
+	fw.Expire()
+
+	if len(mb.History()) != 1 {
+		t.Fatalf("unexpected rules applied while down: %+v", mb.History())
+	}
+
+	mb.SetHealth(nil)
+	fw.RefreshBans()
+
+	history := mb.History()
+	last := history[len(history)-1]
+	if last.Op != MemoryUnban || last.Ban.IP.String() != banTests[0].ip {
+		t.Fatalf("expected the ban to be lifted once back, got %+v", last)
+	}
+}
+
+var cidrTests = []struct {
+	ip     string
+	prefix int
+	cidr   string
+}{
+	{"192.0.2.10", 0, "192.0.2.10/32"},
+	{"192.0.2.10", 24, "192.0.2.0/24"},
+	{"2001:db8::10", 0, "2001:db8::10/128"},
+	{"2001:db8:1:2:3:4:5:6", 64, "2001:db8:1:2::/64"},
+	{"::ffff:192.0.2.10", 0, "192.0.2.10/32"},
+}
+
+func TestBanCIDR(t *testing.T) {
+	for _, tt := range cidrTests {
+		ban := &Ban{IP: net.ParseIP(tt.ip), Prefix: tt.prefix}
+		if ban.CIDR() != tt.cidr {
+			t.Errorf("expected %s/%d to be %s, got %s", tt.ip, tt.prefix, tt.cidr, ban.CIDR())
+		}
+	}
+}
+
+func TestBanNet(t *testing.T) {
+	var tests = []struct {
+		ip     string
+		prefix int
+		bits   int
+		cidr   string
+	}{
+		{"192.0.2.10", 0, 32, "192.0.2.10/32"},
+		{"192.0.2.10", 33, 32, "192.0.2.10/32"},
+		{"::ffff:192.0.2.10", 16, 32, "192.0.0.0/16"},
+		{"2001:db8::10", 129, 128, "2001:db8::10/128"},
+		{"2001:db8::10", 32, 128, "2001:db8::/32"},
+	}
+
+	for _, tt := range tests {
+		network := (&Ban{IP: net.ParseIP(tt.ip), Prefix: tt.prefix}).Net()
+		if _, bits := network.Mask.Size(); bits != tt.bits || len(network.IP) != tt.bits/8 {
+			t.Errorf("%s/%d: expected a %d bit network, got %s", tt.ip, tt.prefix, tt.bits, network)
+		}
+		if network.String() != tt.cidr {
+			t.Errorf("%s/%d: expected %s, got %s", tt.ip, tt.prefix, tt.cidr, network)
+		}
+	}
+}
+
+func TestBanTimeout(t *testing.T) {
+	var tests = []struct {
+		expires time.Time
+		timeout time.Duration
+	}{
+		{time.Time{}, 0},
+		{time.Now().Add(-time.Minute), 0},
+		{time.Now().Add(10*time.Minute + 100*time.Millisecond), 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		ban := &Ban{IP: net.ParseIP("192.0.2.10"), Expires: tt.expires}
+		if timeout := ban.Timeout(); timeout != tt.timeout {
+			t.Errorf("expires %s: expected a timeout of %s, got %s", tt.expires, tt.timeout, timeout)
+		}
+	}
+}
+
+func TestAggregatedBans(t *testing.T) {
+	fw, mb := newTestFirewall(10)
+	fw.whitelist.add("2001:db8:2::1")
+	if err := fw.Aggregate(24, 64); err != nil {
+		t.Fatal(err)
+	}
+
+	peers := []*xrpl.Peer{
+		{Address: "[2001:db8:1::10]:51235", PublicKey: "a"},
+		{Address: "[2001:db8:1::20]:51235", PublicKey: "b"},
+		{Address: "[2001:db8:2::10]:51235", PublicKey: "c"},
+		{Address: "192.0.2.10:51235", PublicKey: "d"},
+	}
+	for _, peer := range peers {
+		fw.BanPeer(peer)
+	}
+
+	expected := []string{"192.0.2.0/24", "2001:db8:1::/64", "2001:db8:2::10/128"}
+	rules := mb.Rules()
+	if len(rules) != len(expected) {
+		t.Fatalf("unexpected number of rules '%d'", len(rules))
+	}
+	for i, rule := range rules {
+		if rule.Ban.CIDR() != expected[i] {
+			t.Errorf("expected rule for %s, got %s", expected[i], rule.Ban.CIDR())
+		}
+	}
+
+	// re-applied bans are aggregated just as they were first applied
+	for _, ban := range fw.blacklist.bans() {
+		if cidr := ban.CIDR(); cidr != expected[0] && cidr != expected[1] && cidr != expected[2] {
+			t.Errorf("unexpected re-applied ban %s", cidr)
+		}
+	}
+
+	// the /64 stays banned while one of its peers is still blacklisted
+	fw.blacklist.entries["a"].expires = time.Now()
+	fw.Expire()
+
+	for _, rule := range mb.History() {
+		if rule.Op == MemoryUnban {
+			t.Fatalf("unexpected unban of %s", rule.Ban.CIDR())
+		}
+	}
+
+	// the whitelisted /64 is lifted as the address it was banned as
+	fw.blacklist.entries["c"].expires = time.Now()
+	fw.Expire()
+
+	history := mb.History()
+	if last := history[len(history)-1]; last.Op != MemoryUnban || last.Ban.CIDR() != "2001:db8:2::10/128" {
+		t.Errorf("expected the /128 to be lifted, got %s of %s", last.Op, last.Ban.CIDR())
+	}
+}
+
+func TestAggregateInvalid(t *testing.T) {
+	fw, _ := newTestFirewall(10)
+	if err := fw.Aggregate(33, 64); err == nil {
+		t.Error("expected an error for an IPv4 prefix of 33")
+	}
+	if err := fw.Aggregate(24, 129); err == nil {
+		t.Error("expected an error for an IPv6 prefix of 129")
+	}
+}
+
+func TestNewAction(t *testing.T) {
+	valid := []struct {
+		kind, with, with6 string
+		port              int
+	}{
+		{"", "", "", 0},
+		{ActionDrop, "", "", 0},
+		{ActionReject, "", "", 0},
+		{ActionReject, "icmp-host-prohibited", "icmp6-adm-prohibited", 0},
+		{ActionTarpit, "", "", 2222},
+	}
+	for _, tt := range valid {
+		if _, err := NewAction(tt.kind, tt.with, tt.with6, tt.port); err != nil {
+			t.Errorf("unexpected error for %+v: %v", tt, err)
+		}
+	}
+
+	invalid := []struct {
+		kind, with, with6 string
+		port              int
+	}{
+		{"accept", "", "", 0},
+		{ActionReject, "icmp6-adm-prohibited", "", 0},
+		{ActionReject, "", "icmp-host-prohibited", 0},
+		{ActionTarpit, "", "", 0},
+		{ActionTarpit, "", "", 70000},
+	}
+	for _, tt := range invalid {
+		if _, err := NewAction(tt.kind, tt.with, tt.with6, tt.port); err == nil {
+			t.Errorf("expected an error for %+v", tt)
+		}
+	}
+}
+
+func TestWithLogLimit(t *testing.T) {
+	for _, limit := range []string{"", "1/s", "10/m", "100/h", "5/d"} {
+		if _, err := (Action{}).WithLogLimit(limit); err != nil {
+			t.Errorf("unexpected error for '%s': %v", limit, err)
+		}
+	}
+	for _, limit := range []string{"10", "0/m", "10/w", "m/10", "-1/s"} {
+		if _, err := (Action{}).WithLogLimit(limit); err == nil {
+			t.Errorf("expected an error for '%s'", limit)
+		}
+	}
+}
+
+var reasonTests = []struct {
+	sanity, reason string
+}{
+	{xrpl.Old, "old-version"},
+	{"", "sanity-good"},
+	{xrpl.Unstable, "sanity-unknown"},
+	{xrpl.Insane, "sanity-insane"},
+	{"Bad Sanity!", "sanity-bad-sanity-"},
+}
+
+func TestBanReason(t *testing.T) {
+	for _, tt := range reasonTests {
+		fw, mb := newTestFirewall(10)
+		fw.BanPeer(&xrpl.Peer{Address: banTests[0].addr, PublicKey: banTests[0].ip, Sanity: tt.sanity})
+		fw.RefreshBans()
+
+		for _, rule := range mb.History() {
+			if rule.Ban.Reason != tt.reason {
+				t.Errorf("expected reason %s for sanity '%s', got %s", tt.reason, tt.sanity, rule.Ban.Reason)
+			}
+		}
+	}
+}
+
+func TestActionAppliedOnRefresh(t *testing.T) {
+	fw, mb := newTestFirewall(10)
+	mb.Action = Action{Type: ActionReject, RejectWith: "icmp-host-prohibited"}
+
+	fw.BanPeer(&xrpl.Peer{Address: banTests[0].addr, PublicKey: banTests[0].ip})
+	fw.RefreshBans()
+
+	history := mb.History()
+	if len(history) != 2 {
+		t.Fatalf("unexpected number of rules applied '%d'", len(history))
+	}
+	if history[0].Action != history[1].Action || history[0].Zone != history[1].Zone {
+		t.Fatalf("refresh applied a different rule: %+v, %+v", history[0], history[1])
+	}
+}
+
+func TestUnbanPeer(t *testing.T) {
+	fw, mb := newTestFirewall(10)
+
+	for _, tt := range banTests {
+		fw.BanPeer(&xrpl.Peer{Address: tt.addr, PublicKey: tt.ip})
+	}
+
+	bans, err := fw.UnbanPeer(banTests[0].ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans[0].CIDR() != banTests[0].ip+"/32" {
+		t.Fatalf("unexpected bans lifted: %v", bans)
+	}
+
+	// by public key
+	if _, err := fw.UnbanPeer(banTests[1].ip); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mb.Rules()) != 0 {
+		t.Fatalf("unexpected number of rules '%d'", len(mb.Rules()))
+	}
+	if len(fw.blacklist.entries) != 0 {
+		t.Fatalf("unexpected number of blacklist entries '%d'", len(fw.blacklist.entries))
+	}
+
+	// pardoned peers are not banned again straight away
+	fw.BanPeer(&xrpl.Peer{Address: banTests[0].addr, PublicKey: banTests[0].ip})
+	if len(mb.Rules()) != 0 {
+		t.Fatal("unbanned peer was banned again")
+	}
+
+	if _, err := fw.UnbanPeer("unknown"); err == nil {
+		t.Fatal("expected an error unbanning an unknown public key")
+	}
+}
+
+func TestUnbanPeerSharedNetwork(t *testing.T) {
+	fw, mb := newTestFirewall(10)
+	if err := fw.Aggregate(24, 64); err != nil {
+		t.Fatal(err)
+	}
+
+	fw.BanPeer(&xrpl.Peer{Address: "192.0.2.10:51235", PublicKey: "a"})
+	fw.BanPeer(&xrpl.Peer{Address: "192.0.2.20:51235", PublicKey: "b"})
+
+	bans, err := fw.UnbanPeer("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans[0].CIDR() != "192.0.2.0/24" {
+		t.Fatalf("unexpected bans lifted: %v", bans)
+	}
+
+	// the other peer in the network must not be re-applied on refresh
+	fw.RefreshBans()
+	if len(mb.Rules()) != 0 {
+		t.Fatalf("unexpected number of rules '%d'", len(mb.Rules()))
+	}
+}
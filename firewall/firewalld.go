@@ -17,16 +17,17 @@ limitations under the License.
 */
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/gnanderson/xrpl"
 	"github.com/godbus/dbus"
 )
 
@@ -35,307 +36,604 @@ const (
 	fwdObjPath     = "/org/fedoraproject/FirewallD1"
 	fwdInterface   = "org.fedoraproject.FirewallD1"
 	alreadyEnabled = "ALREADY_ENABLED"
+	notEnabled     = "NOT_ENABLED"
+	invalidIPSet   = "INVALID_IPSET"
 )
 
 const (
 	protoTCP = "tcp"
 )
 
-var (
-	dbusConn *dbus.Conn
-	dbusObj  dbus.BusObject
-	fwdUp    bool
-	defZone  string
+// how often Watch retries the connection while firewalld is away, a variable
+// so the tests can shorten it
+var fwdRetry = 10 * time.Second
 
+var (
 	errAlreadyEnabled = errors.New(alreadyEnabled)
+	errNotEnabled     = errors.New(notEnabled)
+	errNotRunning     = errors.New("firewalld: not running")
 )
 
-type rejectRule struct {
-	family  string
-	source  net.IP
+// the rich rule family for a network
+func ruleFamily(network *net.IPNet) string {
+	if network.IP.To4() == nil {
+		return "ipv6"
+	}
+
+	return "ipv4"
+}
+
+// This is a simple rich rule definition based on the source address or
+// network, the action is taken on all traffic from the source or, if the
+// action is port scoped, on its traffic to or from the peer port. The rule when
+// printed in it's string format is not permanent because it is intended to be
+// used with the firewalld rich rule timeout option. The traffic is logged with
+// the reason for the ban, which also marks the rule as rbh's.
+type richRule struct {
+	family string
+	source *net.IPNet
+	// the port, log and action elements, see Action.richActions
+	action  string
 	timeout int
 }
 
-// This is a simple reject rich rule definition based on the source ip. The
-// rule when printed in it's string format is not permanent because it is
-// intended to be used with the firewalld rich rule timeout option.
-func newRejectRule(ip string, timeout int) (*rejectRule, error) {
-	IP := net.ParseIP(ip)
-	if IP == nil {
-		return nil, fmt.Errorf("firewalld: invalid IP address '%s'", IP)
+// newRichRules returns the rich rules taking the action on the source, a port
+// scoped action takes more than one
+func newRichRules(source string, action Action, reason string, timeout int) ([]*richRule, error) {
+	network, err := parseSource(source)
+	if err != nil {
+		return nil, err
 	}
 
-	family := "ipv4"
-	if IP.To4() == nil {
-		family = "ipv6"
+	family := ruleFamily(network)
+	rules := make([]*richRule, 0)
+	for _, elements := range action.richActions(family == "ipv6", reason) {
+		rules = append(rules, &richRule{
+			family:  family,
+			source:  network,
+			action:  elements,
+			timeout: timeout,
+		})
 	}
 
-	return &rejectRule{family: family, source: IP, timeout: timeout}, nil
+	return rules, nil
 }
 
-func (rr *rejectRule) String() string {
+func (rr *richRule) String() string {
 	return fmt.Sprintf(
-		"rule family='%s' source address='%s/32' reject",
+		"rule family='%s' source address='%s' %s",
 		rr.family,
 		rr.source.String(),
+		rr.action,
 	)
 }
 
-type dropRule struct {
-	family  string
-	source  net.IP
-	timeout int
-}
-
-func newDropRule(ip string, timeout int) (*dropRule, error) {
-	IP := net.ParseIP(ip)
-	if IP == nil {
-		return nil, fmt.Errorf("firewalld: invalid IP address '%s'", IP)
+// NewFirewalldBackend connects to firewalld over a private connection to the
+// system bus, so each backend has its own, and resolves the zone bans are added
+// to, see ResolveZone. Close the backend when it is no longer needed.
+func NewFirewalldBackend(zone, iface string, action Action) (*FirewalldBackend, error) {
+	fwd := &FirewalldBackend{Action: action}
+	if err := fwd.connect(); err != nil {
+		return nil, err
 	}
 
-	family := "ipv4"
-	if IP.To4() == nil {
-		family = "ipv6"
+	zone, err := fwd.ResolveZone(zone, iface)
+	if err != nil {
+		fwd.Close()
+		return nil, err
 	}
+	fwd.Zone = zone
 
-	return &dropRule{family: family, source: IP, timeout: timeout}, nil
+	return fwd, nil
 }
 
-func (dr *dropRule) String() string {
-	return fmt.Sprintf(
-		"rule family='%s' source address='%s/32' drop",
-		dr.family,
-		dr.source.String(),
-	)
-}
+// connect queries DBUS to see if we can retrieve the firewalld default zone and
+// therefor understand if firewalld is up. A new connection to the bus is made
+// if there isn't one.
+func (fwd *FirewalldBackend) connect() error {
+	fwd.connMu.Lock()
+	defer fwd.connMu.Unlock()
 
-// Connect queries DBUS to see if we can retrieve the firewalld default zone and
-// therefor understand if firewalld is up
-func Connect() (err error) {
-	if dbusConn, err = dbus.SystemBus(); err != nil {
-		log.Println("dbus:", err)
-		fwdUp = false
-		return err
+	if fwd.conn == nil {
+		conn, err := dbusConnect()
+		if err != nil {
+			fwd.up = false
+			return fmt.Errorf("dbus: %v", err)
+		}
+		fwd.conn = conn
 	}
 
-	dbusObj = dbusConn.Object(fwdInterface, dbus.ObjectPath(fwdObjPath))
+	obj := fwd.conn.Object(fwdInterface, dbus.ObjectPath(fwdObjPath))
 
-	if err = dbusObj.Call(fwdInterface+".getDefaultZone", 0).Store(&defZone); err != nil {
-		log.Println("firewalld: cannot retrieve zone, check user permission or firewalld status", err)
-		dbusConn.Close()
-		return err
+	var zone string
+	if err := obj.Call(fwdInterface+".getDefaultZone", 0).Store(&zone); err != nil {
+		fwd.up = false
+		return fmt.Errorf("firewalld: cannot retrieve zone, check user permission or firewalld status: %v", err)
 	}
-	log.Println("firewall: zone - ", defZone)
-	fwdUp = true
+	log.Println("firewall: zone - ", zone)
 
-	return nil
-}
+	fwd.obj, fwd.defZone, fwd.up = obj, zone, true
 
-// Up returns true if firewalld is available to use
-func Up() bool {
-	return fwdUp
+	return nil
 }
 
-// If the service tries to add an existing rich rule specify this error so we
-// can ignore and take no action.
-func toKnownErr(err error) error {
-	if err == nil {
-		return err
+// a new private, authenticated, connection to the system bus
+func dbusConnect() (*dbus.Conn, error) {
+	conn, err := dbus.SystemBusPrivate()
+	if err != nil {
+		return nil, err
 	}
 
-	switch {
-	case strings.HasPrefix(err.Error(), alreadyEnabled):
-		return errAlreadyEnabled
+	if err = conn.Auth(nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = conn.Hello(); err != nil {
+		conn.Close()
+		return nil, err
 	}
 
-	return err
+	return conn, nil
+}
+
+// Close drops the connection to firewalld, the bans are left in place
+func (fwd *FirewalldBackend) Close() error {
+	fwd.disconnect(true)
+
+	return nil
 }
 
-// NotifyReload on a channel if firewalld is reloaded by sysadmin/ops, we'll want to
-// know about this so we can re-apply any bans in the blacklist that have not
-// expired
-func NotifyReload(notify chan<- *dbus.Signal) {
-	if dbusConn == nil {
-		panic("firewall not available")
+// the firewalld object, or errNotRunning while firewalld is down
+func (fwd *FirewalldBackend) object() (dbus.BusObject, error) {
+	fwd.connMu.RLock()
+	defer fwd.connMu.RUnlock()
+
+	if fwd.obj == nil || !fwd.up {
+		return nil, errNotRunning
 	}
-	dbusConn.BusObject().(*dbus.Object).AddMatchSignal(fwdInterface, "Reloaded")
-	dbusConn.Signal(notify)
+
+	return fwd.obj, nil
 }
 
-type blEntry struct {
-	peer    *xrpl.Peer
-	expires time.Time
+// another firewalld object on the connection, e.g. the permanent config
+func (fwd *FirewalldBackend) objectAt(path dbus.ObjectPath) (dbus.BusObject, error) {
+	fwd.connMu.RLock()
+	defer fwd.connMu.RUnlock()
+
+	if fwd.conn == nil || !fwd.up {
+		return nil, errNotRunning
+	}
+
+	return fwd.conn.Object(fwdInterface, path), nil
 }
 
-func (ble *blEntry) expired() bool {
-	return ble.expires.Sub(time.Now()) < 0
+// the firewalld default zone when it was last connected
+func (fwd *FirewalldBackend) defaultZone() string {
+	fwd.connMu.RLock()
+	defer fwd.connMu.RUnlock()
+
+	return fwd.defZone
 }
 
-type blacklist struct {
-	sync.Mutex
-	entries  map[string]*blEntry
-	duration time.Duration
+// mark firewalld down, dropping the connection too if the bus has gone away
+func (fwd *FirewalldBackend) disconnect(bus bool) {
+	fwd.connMu.Lock()
+	defer fwd.connMu.Unlock()
+
+	fwd.up = false
+	if bus && fwd.conn != nil {
+		fwd.conn.Close()
+		fwd.conn, fwd.obj = nil, nil
+	}
 }
 
-func (bl *blacklist) add(peer *xrpl.Peer) {
-	bl.Lock()
-	defer bl.Unlock()
+// subscribe to firewalld reloads and to firewalld joining or leaving the bus
+func (fwd *FirewalldBackend) subscribe(signals chan *dbus.Signal) error {
+	fwd.connMu.RLock()
+	defer fwd.connMu.RUnlock()
 
-	newEntry := &blEntry{
-		peer:    peer,
-		expires: time.Now().Add(bl.duration),
+	if fwd.conn == nil {
+		return errNotRunning
 	}
 
-	if _, ok := bl.entries[peer.PublicKey]; !ok {
-		bl.entries[peer.PublicKey] = newEntry
+	bus := fwd.conn.BusObject().(*dbus.Object)
+	if err := bus.AddMatchSignal(fwdInterface, "Reloaded").Err; err != nil {
+		return err
+	}
+	err := bus.AddMatchSignal(
+		"org.freedesktop.DBus",
+		"NameOwnerChanged",
+		dbus.WithMatchOption("arg0", fwdInterface),
+	).Err
+	if err != nil {
+		return err
 	}
-}
 
-func (bl *blacklist) contains(peer *xrpl.Peer) bool {
-	bl.Lock()
-	defer bl.Unlock()
+	fwd.conn.Signal(signals)
 
-	if _, ok := bl.entries[peer.PublicKey]; ok {
-		return true
-	}
-	return false
+	return nil
 }
 
-func (bl *blacklist) expireEntries() {
-	bl.Lock()
-	defer bl.Unlock()
+// Watch keeps the backend connected to firewalld until the context is done.
+// refresh is called whenever the bans need to be re-applied: when firewalld is
+// reloaded, when it is restarted and when the system bus itself is restarted.
+// While firewalld is away Health returns an error and the connection is
+// retried.
+func (fwd *FirewalldBackend) Watch(ctx context.Context, refresh func()) {
+	go func() {
+		for {
+			signals := make(chan *dbus.Signal, 16)
+			if err := fwd.subscribe(signals); err == nil {
+				if !fwd.watch(ctx, signals, refresh) {
+					return
+				}
+			}
+
+			fwd.disconnect(true)
+			if !fwd.reconnect(ctx) {
+				return
+			}
+			refresh()
+		}
+	}()
+}
 
-	for _, entry := range bl.entries {
-		if entry.expired() {
-			delete(bl.entries, entry.peer.PublicKey)
+// handle signals until the context is done, false, or the connection needs to
+// be replaced, true
+func (fwd *FirewalldBackend) watch(ctx context.Context, signals chan *dbus.Signal, refresh func()) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case signal, ok := <-signals:
+			if !ok {
+				log.Println("firewalld: lost the system bus")
+				return true
+			}
+
+			switch signal.Name {
+			case fwdInterface + ".Reloaded":
+				log.Println("firewalld: reloaded")
+				refresh()
+			case "org.freedesktop.DBus.NameOwnerChanged":
+				if len(signal.Body) < 3 {
+					continue
+				}
+				if owner, _ := signal.Body[2].(string); owner == "" {
+					log.Println("firewalld: stopped")
+					fwd.disconnect(false)
+					continue
+				}
+				log.Println("firewalld: started")
+				if err := fwd.connect(); err != nil {
+					log.Println(err)
+					return true
+				}
+				refresh()
+			}
 		}
 	}
 }
 
-type whitelist struct {
-	entries map[string]*xrpl.Peer
+// retry connect until it succeeds, true, or the context is done, false
+func (fwd *FirewalldBackend) reconnect(ctx context.Context) bool {
+	ticker := time.NewTicker(fwdRetry)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+			if err := fwd.connect(); err == nil {
+				return true
+			}
+		}
+	}
 }
 
-func (wl *whitelist) add(ip string) {
-	if _, ok := wl.entries[ip]; !ok {
-		wl.entries[ip] = nil
+// ResolveZone returns the zone bans should be added to. If an interface is
+// given the zone is the one the interface is bound to, if a zone is also given
+// the two must agree. An empty zone and interface is the default zone. The zone
+// must be one firewalld knows about.
+func (fwd *FirewalldBackend) ResolveZone(zone, iface string) (string, error) {
+	obj, err := fwd.object()
+	if err != nil {
+		return "", err
 	}
+
+	if iface != "" {
+		var ifaceZone string
+		err := obj.Call(fwdInterface+".zone.getZoneOfInterface", 0, iface).Store(&ifaceZone)
+		if err != nil {
+			return "", fmt.Errorf("firewalld: cannot retrieve zone of interface '%s': %v", iface, err)
+		}
+		if ifaceZone == "" {
+			return "", fmt.Errorf("firewalld: interface '%s' is not bound to a zone", iface)
+		}
+		if zone != "" && zone != ifaceZone {
+			return "", fmt.Errorf("firewalld: interface '%s' is in zone '%s' not '%s'", iface, ifaceZone, zone)
+		}
+		zone = ifaceZone
+	}
+
+	if zone == "" {
+		return fwd.defaultZone(), nil
+	}
+
+	var zones []string
+	if err := obj.Call(fwdInterface+".zone.getZones", 0).Store(&zones); err != nil {
+		return "", fmt.Errorf("firewalld: cannot list zones: %v", err)
+	}
+
+	for _, known := range zones {
+		if known == zone {
+			return zone, nil
+		}
+	}
+
+	return "", fmt.Errorf("firewalld: unknown zone '%s'", zone)
 }
 
-func (wl *whitelist) contains(peer *xrpl.Peer) bool {
-	if _, ok := wl.entries[peer.IP().String()]; ok {
-		// always update the peer data with current known state
-		wl.entries[peer.IP().String()] = peer
-		return true
+// If the service tries to add an existing rich rule, or remove one that does
+// not exist, specify these errors so we can ignore and take no action.
+func toKnownErr(err error) error {
+	if err == nil {
+		return err
 	}
-	return false
+
+	switch {
+	case strings.HasPrefix(err.Error(), alreadyEnabled):
+		return errAlreadyEnabled
+	case strings.HasPrefix(err.Error(), notEnabled):
+		return errNotEnabled
+	}
+
+	return err
 }
 
-// Firewall is a wrapper round `firewalld` that provides functionality for
-// temporarily banning XRPL peer nodes
-type Firewall struct {
-	Disconnector Disconnector
-	whitelist    *whitelist
-	blacklist    *blacklist
+// FirewalldBackend enforces bans via the firewalld D-Bus API. By default each
+// ban is a timed rich rule in the Zone taking the configured Action, firewalld
+// itself removes the rule when the timeout is reached. With IPSet set, banned
+// peers are instead added to the zone's firewalld ipsets, e.g. rbh-public-v4 or
+// rbh-public-v6, which a single rich rule per set drops. Create them with
+// CreateIPSets before the first ban. firewalld does not support timeouts on
+// entries of the ipsets it manages so these are removed when the ban expires
+// in the Firewall.
+//
+// Runtime rules and entries are lost if firewalld is restarted or the host is
+// rebooted. With Permanent set each ban is also written to the permanent
+// config, without a timeout, and removed from both when the ban expires in the
+// Firewall.
+//
+// Use NewFirewalldBackend to connect the backend, and Watch to keep it
+// connected.
+type FirewalldBackend struct {
+	IPSet     bool
+	Permanent bool
+	Action    Action
+	// Zone the rules are added to, the default zone if empty. This should be
+	// the zone governing the interface rippled receives peer connections on,
+	// see ResolveZone.
+	Zone string
+
+	mu    sync.Mutex
+	ready bool // ipsets and their rich rules are in place
+
+	// the connection to firewalld, replaced by Watch if firewalld or the
+	// bus is restarted
+	connMu  sync.RWMutex
+	conn    *dbus.Conn
+	obj     dbus.BusObject
+	up      bool
+	defZone string
 }
 
-// NewFirewall instantiates a Firewall ready for use with XRPL peer nodes
-func NewFirewall(banLength int, whiteList ...string) *Firewall {
-	fw := &Firewall{
-		Disconnector: DefaultDisconnector,
-		whitelist:    &whitelist{entries: make(map[string]*xrpl.Peer)},
-		blacklist: &blacklist{
-			entries:  make(map[string]*blEntry),
-			duration: time.Duration(banLength) * time.Minute,
-		},
+// Ban inserts the rich rules for the source in the zone, or adds the source to
+// the ipset
+func (fwd *FirewalldBackend) Ban(ban *Ban) error {
+	if fwd.IPSet {
+		return fwd.banIPSet(ban)
+	}
+
+	rules, err := newRichRules(ban.CIDR(), fwd.Action, ban.Reason, int(ban.Timeout().Seconds()))
+	if err != nil {
+		return err
 	}
 
-	for _, entry := range whiteList {
-		fw.whitelist.add(entry)
+	for _, rule := range rules {
+		if err := fwd.addBanRule(rule); err != nil {
+			return err
+		}
 	}
 
-	return fw
+	return nil
 }
 
-// BanPeer bans the XRPL peer by inserting the reject rule, and adds it to a
-// blacklist so we can track the expiration and re-apply on firewalld reload.
-// IP's that are in the whitelist are ignored...
-func (fw *Firewall) BanPeer(peer *xrpl.Peer) {
-	if fw.whitelist.contains(peer) {
-		return
+// insert a ban's rich rule, in the permanent config too in Permanent mode
+func (fwd *FirewalldBackend) addBanRule(rule *richRule) error {
+	if fwd.Permanent {
+		if err := ignoreKnown(fwd.addPermanentRichRule(fwd.Zone, rule.String())); err != nil {
+			return err
+		}
+		rule.timeout = 0
 	}
 
-	drop, err := newDropRule(
-		peer.IP().String(),
-		int(fw.blacklist.duration.Seconds()),
-	)
+	err := fwd.addRichRule(fwd.Zone, rule.String(), rule.timeout)
+	if err == errAlreadyEnabled {
+		return nil
+	}
+
+	return err
+}
 
+// Unban removes the rich rules rbh has inserted for the source, and with IPSet
+// set removes the source from the ipset too, as rbh ban always inserts rich
+// rules. If a rule was inserted with a different action or reason, e.g. by an
+// rbh run with other flags, it is found by the source instead. Only rules
+// marked as rbh's are ever removed.
+func (fwd *FirewalldBackend) Unban(ban *Ban) error {
+	if fwd.IPSet {
+		if err := fwd.unbanIPSet(ban); err != nil {
+			return err
+		}
+	}
+
+	expected, err := newRichRules(ban.CIDR(), fwd.Action, ban.Reason, 0)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
-	err = fw.addReject("drop", drop.String(), int(fw.blacklist.duration.Seconds()))
-	if err != errAlreadyEnabled && err != nil {
-		log.Println(err)
+	missing := false
+	for _, rule := range expected {
+		if fwd.Permanent {
+			if err := ignoreKnown(fwd.removePermanentRichRule(fwd.Zone, rule.String())); err != nil {
+				return err
+			}
+		}
+
+		err := fwd.removeRichRule(fwd.Zone, rule.String())
+		if err == errNotEnabled {
+			missing = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !missing {
+		return nil
 	}
 
-	fw.blacklist.add(peer)
+	rules, err := fwd.getRichRules(fwd.Zone)
+	if err != nil {
+		return err
+	}
+	for _, existing := range rules {
+		if found := parseRichRule(existing); found != nil && found.CIDR() == ban.CIDR() {
+			if err := fwd.removeRichRule(fwd.Zone, existing); err != nil && err != errNotEnabled {
+				return err
+			}
+		}
+	}
 
-	fw.Disconnect(peer)
+	if !fwd.Permanent {
+		return nil
+	}
+
+	rules, err = fwd.getPermanentRichRules(fwd.Zone)
+	if err != nil {
+		return err
+	}
+	for _, existing := range rules {
+		if found := parseRichRule(existing); found != nil && found.CIDR() == ban.CIDR() {
+			if err := ignoreKnown(fwd.removePermanentRichRule(fwd.Zone, existing)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
-// Expire will traverse the blacklist and remove any XRPL peers which have
-// exceeded their ban length
-func (fw *Firewall) Expire() {
-	fw.blacklist.expireEntries()
+// List returns the bans found in the zone, or the ipsets. firewalld does not
+// expose the remaining timeout on a rich rule so the expiry is left unset.
+func (fwd *FirewalldBackend) List() ([]*Ban, error) {
+	if fwd.IPSet {
+		return fwd.listIPSet()
+	}
+
+	rules, err := fwd.getRichRules(fwd.Zone)
+	if err != nil {
+		return nil, err
+	}
+
+	// a port scoped ban has more than one rule
+	seen := make(map[string]bool)
+	bans := make([]*Ban, 0)
+	for _, rule := range rules {
+		if ban := parseRichRule(rule); ban != nil && !seen[ban.CIDR()] {
+			seen[ban.CIDR()] = true
+			bans = append(bans, ban)
+		}
+	}
+
+	return bans, nil
 }
 
-// RefreshBans re-applies the rich rule banning unstable peers, this is used
-// after the firewall reload notify signal.
-func (fw *Firewall) RefreshBans() {
-	fw.Expire()
-	for _, entry := range fw.blacklist.entries {
-		reject, err := newRejectRule(
-			entry.peer.IP().String(),
-			int(entry.expires.Sub(time.Now()).Seconds()),
-		)
-		if err != nil {
-			log.Println(err)
+// Reconcile re-applies the rich rule for each ban with the time remaining on
+// the ban, exactly as Ban does, or re-adds each ban to the ipsets
+func (fwd *FirewalldBackend) Reconcile(bans []*Ban) error {
+	if fwd.IPSet {
+		return fwd.reconcileIPSet(bans)
+	}
+
+	for _, ban := range bans {
+		if ban.Timeout() <= 0 {
 			continue
 		}
 
-		err = fw.addReject(
-			"public",
-			reject.String(),
-			int(fw.blacklist.duration.Seconds()),
-		)
-		if err != errAlreadyEnabled && err != nil {
+		if err := fwd.Ban(ban); err != nil {
 			log.Println(err)
 		}
 	}
+
+	return nil
+}
+
+// Health returns an error if firewalld is not connected
+func (fwd *FirewalldBackend) Health() error {
+	_, err := fwd.object()
+
+	return err
 }
 
-// Disconnect a peer socket
-func (fw *Firewall) Disconnect(peer *xrpl.Peer) {
-	if err := fw.Disconnector.Disconnect(peer); err != nil {
-		log.Println("firewall disconnect:", err)
+// rich rules inserted by rbh always take this form, see richRule.String.
+// firewalld may add the default log level when it lists the rule. A tarpit's
+// forward-port is listed before the log.
+var richRuleRe = regexp.MustCompile(
+	`^rule family=["']ipv[46]["'] source address=["']([^"'/]+)(/\d+)?["'] ` +
+		`(?:(?:port|source-port|forward-port) port=["']\d+["'] protocol=["']tcp["'] (?:to-port=["']\d+["'] )?)?` +
+		`log prefix=["']` + regexp.QuoteMeta(LogPrefix) + `([^"']*)["']` +
+		`(?: level=["']\w+["'])?(?: limit value=["'][^"']+["'])?` +
+		`(?: (?:drop|reject)\b|$)`,
+)
+
+// parseRichRule returns the ban for a rich rule inserted by rbh, or nil if the
+// rule is not recognised, i.e. it is not marked as rbh's
+func parseRichRule(rule string) *Ban {
+	match := richRuleRe.FindStringSubmatch(strings.TrimSpace(rule))
+	if match == nil {
+		return nil
+	}
+
+	IP := net.ParseIP(match[1])
+	if IP == nil {
+		return nil
+	}
+
+	ban := &Ban{IP: IP, Reason: match[3]}
+	if match[2] != "" {
+		ban.Prefix, _ = strconv.Atoi(match[2][1:])
 	}
+
+	return ban
 }
 
-// Insert the reject rich rule
-func (fw *Firewall) addReject(zone, rule string, timeout int) error {
+// Insert a rich rule
+func (fwd *FirewalldBackend) addRichRule(zone, rule string, timeout int) error {
 	if zone == "" {
-		zone = defZone
+		zone = fwd.defaultZone()
 	}
 
-	if dbusObj == nil || !fwdUp {
-		return errors.New("firewalld: not running")
+	obj, err := fwd.object()
+	if err != nil {
+		return err
 	}
 
 	log.Println(fmt.Sprintf("firewalld: adding rule (%s) to %s zone", rule, zone))
 
-	return toKnownErr(dbusObj.Call(
+	return toKnownErr(obj.Call(
 		fwdInterface+".zone.addRichRule",
 		0,
 		zone,
@@ -344,23 +642,62 @@ func (fw *Firewall) addReject(zone, rule string, timeout int) error {
 	).Store(&zone))
 }
 
+// Remove a rich rule
+func (fwd *FirewalldBackend) removeRichRule(zone, rule string) error {
+	if zone == "" {
+		zone = fwd.defaultZone()
+	}
+
+	obj, err := fwd.object()
+	if err != nil {
+		return err
+	}
+
+	log.Println(fmt.Sprintf("firewalld: removing rule (%s) from %s zone", rule, zone))
+
+	return toKnownErr(obj.Call(
+		fwdInterface+".zone.removeRichRule",
+		0,
+		zone,
+		rule,
+	).Store(&zone))
+}
+
+// Retrieve the rich rules in a zone
+func (fwd *FirewalldBackend) getRichRules(zone string) ([]string, error) {
+	if zone == "" {
+		zone = fwd.defaultZone()
+	}
+
+	obj, err := fwd.object()
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []string
+	err = obj.Call(fwdInterface+".zone.getRichRules", 0, zone).Store(&rules)
+
+	return rules, err
+}
+
 // add a port in a zone - currently unused but included for future functionality
-func addPort(zone string, port, timeout int) error {
+func (fwd *FirewalldBackend) addPort(zone string, port, timeout int) error {
 	if zone == "" {
-		zone = defZone
+		zone = fwd.defaultZone()
 	}
 
 	if port <= 0 {
 		return fmt.Errorf("firewalld: invalid port '%d'", port)
 	}
 
-	if dbusObj == nil || !fwdUp {
-		return errors.New("firewalld: not running")
+	obj, err := fwd.object()
+	if err != nil {
+		return err
 	}
 
 	log.Println(fmt.Sprintf("firewalld: adding port '%d' added to %s zone", port, zone))
 
-	return dbusObj.Call(
+	return obj.Call(
 		fwdInterface+".zone.addPort",
 		0,
 		zone,
@@ -371,22 +708,23 @@ func addPort(zone string, port, timeout int) error {
 }
 
 // remove a port in a zone - currently unused but included for future functionality
-func removePort(zone string, port, timeout int) error {
+func (fwd *FirewalldBackend) removePort(zone string, port, timeout int) error {
 	if zone == "" {
-		zone = defZone
+		zone = fwd.defaultZone()
 	}
 
 	if port <= 0 {
 		return fmt.Errorf("firewalld: invalid port '%d'", port)
 	}
 
-	if dbusObj == nil || !fwdUp {
-		return errors.New("firewalld: not running")
+	obj, err := fwd.object()
+	if err != nil {
+		return err
 	}
 
 	log.Println(fmt.Sprintf("firewalld: removing port '%d' from %s zone", port, zone))
 
-	return dbusObj.Call(
+	return obj.Call(
 		fwdInterface+".zone.removePort",
 		0,
 		zone,
@@ -0,0 +1,540 @@
+package firewall
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnanderson/xrpl"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// These tests run the firewalld backend against fakeFirewalld on a private
+// bus, they are skipped where dbus-daemon is not installed.
+
+func newTestFirewalld(t *testing.T, zone, iface string) (*FirewalldBackend, *fakeFirewalld) {
+	t.Helper()
+
+	fake := newFakeFirewalld(t)
+	fwd, err := NewFirewalldBackend(zone, iface, Action{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fwd.Close() })
+
+	return fwd, fake
+}
+
+func testBan(ip, reason string) *Ban {
+	return &Ban{IP: net.ParseIP(ip), Expires: time.Now().Add(time.Hour), Reason: reason}
+}
+
+func TestFirewalldRichRules(t *testing.T) {
+	fwd, fake := newTestFirewalld(t, "", "")
+
+	if fwd.Zone != "public" {
+		t.Fatalf("expected the default zone, got '%s'", fwd.Zone)
+	}
+
+	ban := testBan("192.0.2.10", "sanity-insane")
+	if err := fwd.Ban(ban); err != nil {
+		t.Fatal(err)
+	}
+	// firewalld returns ALREADY_ENABLED for the same rule, which is ignored
+	if err := fwd.Ban(ban); err != nil {
+		t.Fatal("second ban:", err)
+	}
+
+	rules := fake.Rules("public")
+	if len(rules) != 1 {
+		t.Fatalf("expected one rule, got %v", rules)
+	}
+	for rule, timeout := range rules {
+		if !strings.Contains(rule, `source address="192.0.2.10/32"`) || !strings.Contains(rule, "rbh:sanity-insane") {
+			t.Errorf("unexpected rule '%s'", rule)
+		}
+		if timeout < 3500 || timeout > 3600 {
+			t.Errorf("expected the rule to time out with the ban, got %d", timeout)
+		}
+	}
+
+	// a rule rbh did not add is listed and unbanned around
+	fake.AddRule("public", "rule family='ipv4' source address='192.0.2.10' drop")
+
+	bans, err := fwd.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans[0].CIDR() != "192.0.2.10/32" || bans[0].Reason != "sanity-insane" {
+		t.Fatalf("unexpected bans listed %v", bans)
+	}
+
+	if err := fwd.Unban(&Ban{IP: net.ParseIP("192.0.2.10")}); err != nil {
+		t.Fatal(err)
+	}
+	if rules := fake.Rules("public"); len(rules) != 1 {
+		t.Fatalf("expected only the foreign rule to remain, got %v", rules)
+	}
+	// firewalld returns NOT_ENABLED for a missing rule, which is ignored
+	if err := fwd.Unban(ban); err != nil {
+		t.Fatal("second unban:", err)
+	}
+}
+
+func TestFirewalldTarpit(t *testing.T) {
+	fwd, fake := newTestFirewalld(t, "", "")
+	fwd.Action = Action{Type: ActionTarpit, ToPort: 2222}
+
+	if err := fwd.Ban(testBan("192.0.2.10", ReasonBanned)); err != nil {
+		t.Fatal(err)
+	}
+
+	// firewalld lists the forward-port element before the log
+	expected := `rule family="ipv4" source address="192.0.2.10/32" forward-port port="51235" protocol="tcp" to-port="2222" log prefix="rbh:banned"`
+	if rules := fake.Rules("public"); len(rules) != 1 || rules[expected] == 0 {
+		t.Fatalf("expected rule '%s', got %v", expected, rules)
+	}
+
+	bans, err := fwd.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans[0].CIDR() != "192.0.2.10/32" {
+		t.Fatalf("unexpected bans listed %v", bans)
+	}
+}
+
+func TestFirewalldPortOnly(t *testing.T) {
+	fwd, fake := newTestFirewalld(t, "", "")
+	fwd.Action = Action{PortOnly: true}
+
+	ban := testBan("192.0.2.10", ReasonBanned)
+	if err := fwd.Ban(ban); err != nil {
+		t.Fatal(err)
+	}
+
+	// replies on an outbound connection to the peer come from the peer port
+	rules := fake.Rules("public")
+	for _, expected := range []string{
+		`rule family="ipv4" source address="192.0.2.10/32" port port="51235" protocol="tcp" log prefix="rbh:banned" drop`,
+		`rule family="ipv4" source address="192.0.2.10/32" source-port port="51235" protocol="tcp" log prefix="rbh:banned" drop`,
+	} {
+		if _, ok := rules[expected]; !ok {
+			t.Errorf("expected rule '%s', got %v", expected, rules)
+		}
+	}
+
+	bans, err := fwd.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 {
+		t.Errorf("expected the rules to be listed as one ban, got %v", bans)
+	}
+
+	if err := fwd.Unban(ban); err != nil {
+		t.Fatal(err)
+	}
+	if rules := fake.Rules("public"); len(rules) != 0 {
+		t.Errorf("expected both rules to be removed, got %v", rules)
+	}
+}
+
+func TestFirewalldResolveZone(t *testing.T) {
+	fwd, _ := newTestFirewalld(t, "", "")
+
+	var tests = []struct {
+		zone, iface, want string
+		err               bool
+	}{
+		{"", "", "public", false},
+		{"internal", "", "internal", false},
+		{"", "eth1", "internal", false},
+		{"internal", "eth1", "internal", false},
+		{"public", "eth1", "", true},
+		{"", "eth9", "", true},
+		{"dmz", "", "", true},
+	}
+
+	for _, tt := range tests {
+		zone, err := fwd.ResolveZone(tt.zone, tt.iface)
+		if (err != nil) != tt.err {
+			t.Errorf("zone '%s' interface '%s': unexpected error %v", tt.zone, tt.iface, err)
+		}
+		if zone != tt.want {
+			t.Errorf("zone '%s' interface '%s': expected '%s' got '%s'", tt.zone, tt.iface, tt.want, zone)
+		}
+	}
+}
+
+func TestFirewalldZoneOfInterface(t *testing.T) {
+	fwd, fake := newTestFirewalld(t, "", "eth1")
+	if fwd.Zone != "internal" {
+		t.Fatalf("expected the zone of eth1, got '%s'", fwd.Zone)
+	}
+
+	fake.AddRule("public", `rule family="ipv4" source address="198.51.100.10" log prefix="rbh:banned" drop`)
+	if err := fwd.Ban(testBan("192.0.2.10", ReasonBanned)); err != nil {
+		t.Fatal(err)
+	}
+
+	if rules := fake.Rules("internal"); len(rules) != 1 {
+		t.Errorf("expected the ban in the internal zone, got %v", rules)
+	}
+	bans, err := fwd.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans[0].CIDR() != "192.0.2.10/32" {
+		t.Errorf("expected only the internal zone to be listed, got %v", bans)
+	}
+
+	if _, err := NewFirewalldBackend("dmz", "", Action{}); err == nil || !strings.Contains(err.Error(), "unknown zone") {
+		t.Errorf("expected an unknown zone error, got %v", err)
+	}
+}
+
+func TestFirewalldIPSet(t *testing.T) {
+	fwd, fake := newTestFirewalld(t, "internal", "")
+	fwd.IPSet = true
+
+	// a ban never reloads firewalld to create the ipsets
+	bans := []*Ban{testBan("192.0.2.10", ReasonBanned), testBan("2001:db8::10", ReasonBanned)}
+	if err := fwd.Ban(bans[0]); err == nil {
+		t.Fatal("expected an error banning before the ipsets are created")
+	}
+	if reloads := fake.Reloads(); reloads != 0 {
+		t.Fatalf("unexpected reloads %d", reloads)
+	}
+
+	// they are created with a single reload, and only once
+	for i := 0; i < 2; i++ {
+		if err := fwd.CreateIPSets(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reloads := fake.Reloads(); reloads != 1 {
+		t.Fatalf("expected a single reload, got %d", reloads)
+	}
+
+	for _, ban := range bans {
+		if err := fwd.Ban(ban); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if entries := fake.Entries("rbh-internal-v4"); len(entries) != 1 || entries[0] != "192.0.2.10/32" {
+		t.Errorf("unexpected rbh-internal-v4 entries %v", entries)
+	}
+	if entries := fake.Entries("rbh-internal-v6"); len(entries) != 1 || entries[0] != "2001:db8::10/128" {
+		t.Errorf("unexpected rbh-internal-v6 entries %v", entries)
+	}
+	if rules := fake.Rules("internal"); len(rules) != 2 {
+		t.Errorf("expected a rule per ipset, got %v", rules)
+	}
+
+	listed, err := fwd.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 {
+		t.Fatalf("unexpected bans listed %v", listed)
+	}
+
+	// a reload empties the runtime ipsets, reconcile fills them again
+	if err := fake.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if entries := fake.Entries("rbh-internal-v4"); len(entries) != 0 {
+		t.Fatalf("expected the reload to empty the ipset, got %v", entries)
+	}
+	if err := fwd.Reconcile(bans); err != nil {
+		t.Fatal(err)
+	}
+	if entries := fake.Entries("rbh-internal-v4"); len(entries) != 1 {
+		t.Errorf("expected the ban to be reconciled, got %v", entries)
+	}
+
+	if err := fwd.Unban(bans[0]); err != nil {
+		t.Fatal(err)
+	}
+	if entries := fake.Entries("rbh-internal-v4"); len(entries) != 0 {
+		t.Errorf("expected the entry to be removed, got %v", entries)
+	}
+}
+
+func TestFirewalldIPSetPerZone(t *testing.T) {
+	internal, fake := newTestFirewalld(t, "internal", "")
+	internal.IPSet = true
+
+	public, err := NewFirewalldBackend("public", "", Action{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	public.IPSet = true
+
+	for _, fwd := range []*FirewalldBackend{internal, public} {
+		if err := fwd.CreateIPSets(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := internal.Ban(testBan("192.0.2.10", ReasonBanned)); err != nil {
+		t.Fatal(err)
+	}
+	if err := public.Ban(testBan("192.0.2.20", ReasonBanned)); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries := fake.Entries("rbh-internal-v4"); len(entries) != 1 || entries[0] != "192.0.2.10/32" {
+		t.Errorf("unexpected rbh-internal-v4 entries %v", entries)
+	}
+	if entries := fake.Entries("rbh-public-v4"); len(entries) != 1 || entries[0] != "192.0.2.20/32" {
+		t.Errorf("unexpected rbh-public-v4 entries %v", entries)
+	}
+	for rule := range fake.Rules("public") {
+		if !strings.Contains(rule, "rbh-public-") {
+			t.Errorf("unexpected rule '%s' in the public zone", rule)
+		}
+	}
+
+	bans, err := public.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || !bans[0].IP.Equal(net.ParseIP("192.0.2.20")) {
+		t.Errorf("expected only the public zone's ban, got %v", bans)
+	}
+}
+
+func TestFirewalldUnbanIPSet(t *testing.T) {
+	// rbh ban always inserts a timed rich rule, while rbh unban defaults to
+	// IPSet and Permanent when rbh run is not there to handle the unban
+	banner, fake := newTestFirewalld(t, "", "")
+	ban := testBan("192.0.2.10", ReasonManual)
+	if err := banner.Ban(ban); err != nil {
+		t.Fatal(err)
+	}
+
+	fwd, err := NewFirewalldBackend("", "", Action{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fwd.Close()
+	fwd.IPSet = true
+	fwd.Permanent = true
+
+	// the ipsets have never been created, which is not an error
+	if err := fwd.Unban(&Ban{IP: net.ParseIP("192.0.2.10")}); err != nil {
+		t.Fatal(err)
+	}
+	if rules := fake.Rules("public"); len(rules) != 0 {
+		t.Errorf("expected the rich rule to be removed, got %v", rules)
+	}
+}
+
+func TestFirewalldPermanent(t *testing.T) {
+	fwd, fake := newTestFirewalld(t, "", "")
+	fwd.Permanent = true
+
+	ban := testBan("192.0.2.10", ReasonBanned)
+	if err := fwd.Ban(ban); err != nil {
+		t.Fatal(err)
+	}
+
+	if rules := fake.PermanentRules("public"); len(rules) != 1 {
+		t.Fatalf("expected a permanent rule, got %v", rules)
+	}
+	for rule, timeout := range fake.Rules("public") {
+		if timeout != 0 {
+			t.Errorf("expected rule '%s' without a timeout, got %d", rule, timeout)
+		}
+	}
+
+	// the ban survives firewalld being restarted
+	fake.restart(t)
+	if rules := fake.Rules("public"); len(rules) != 1 {
+		t.Fatalf("expected the rule to be restored, got %v", rules)
+	}
+
+	if err := fwd.connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fwd.Unban(ban); err != nil {
+		t.Fatal(err)
+	}
+	if rules := fake.PermanentRules("public"); len(rules) != 0 {
+		t.Errorf("expected the permanent rule to be removed, got %v", rules)
+	}
+	if rules := fake.Rules("public"); len(rules) != 0 {
+		t.Errorf("expected the rule to be removed, got %v", rules)
+	}
+}
+
+func TestFirewalldPermanentExpiry(t *testing.T) {
+	fwd, fake := newTestFirewalld(t, "", "")
+	fwd.Permanent = true
+
+	fw := NewFirewall(10)
+	fw.Backend = fwd
+	fw.Disconnector = &nopDisconnector{}
+
+	fw.BanPeer(&xrpl.Peer{Address: "192.0.2.10:51235", PublicKey: "a"})
+	if rules := fake.PermanentRules("public"); len(rules) != 1 {
+		t.Fatalf("expected a permanent rule, got %v", rules)
+	}
+
+	// firewalld never expires the permanent rule, rbh removes it
+	fw.blacklist.entries["a"].expires = time.Now().Add(-time.Second)
+	fw.Expire()
+
+	if rules := fake.PermanentRules("public"); len(rules) != 0 {
+		t.Errorf("expected the permanent rule to be removed on expiry, got %v", rules)
+	}
+	if rules := fake.Rules("public"); len(rules) != 0 {
+		t.Errorf("expected the rule to be removed on expiry, got %v", rules)
+	}
+}
+
+func TestFirewalldPermanentUnbanBySource(t *testing.T) {
+	fwd, fake := newTestFirewalld(t, "", "")
+	fwd.Permanent = true
+
+	// a ban written by an earlier run with another reason and action
+	fwd.Action = Action{Type: ActionReject}
+	if err := fwd.Ban(testBan("192.0.2.10", "sanity-insane")); err != nil {
+		t.Fatal(err)
+	}
+	fwd.Action = Action{}
+
+	if err := fwd.Unban(testBan("192.0.2.10", ReasonManual)); err != nil {
+		t.Fatal(err)
+	}
+	if rules := fake.PermanentRules("public"); len(rules) != 0 {
+		t.Errorf("expected the permanent rule to be found by its source, got %v", rules)
+	}
+	if rules := fake.Rules("public"); len(rules) != 0 {
+		t.Errorf("expected the rule to be found by its source, got %v", rules)
+	}
+}
+
+func TestFirewalldWatch(t *testing.T) {
+	fwd, fake := newTestFirewalld(t, "", "")
+
+	fw := NewFirewall(10)
+	fw.Backend = fwd
+	fw.Disconnector = &nopDisconnector{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if !fw.Watch(ctx) {
+		t.Fatal("expected the firewalld backend to be watched")
+	}
+
+	fw.BanPeer(&xrpl.Peer{Address: "192.0.2.10:51235", PublicKey: "a"})
+	if rules := fake.Rules("public"); len(rules) != 1 {
+		t.Fatalf("expected a rule, got %v", rules)
+	}
+
+	// the ban is re-applied after firewalld is reloaded, the reload is repeated
+	// as the watch may not have subscribed to the signal yet
+	eventually(t, "the ban to be re-applied after a reload", func() bool {
+		if err := fake.reload(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		return len(fake.Rules("public")) == 1
+	})
+
+	// bans made while firewalld is stopped are applied once it is back
+	fake.stop()
+	eventually(t, "the backend to go down", func() bool { return !fw.Up() })
+
+	fw.BanPeer(&xrpl.Peer{Address: "192.0.2.11:51235", PublicKey: "b"})
+
+	fake.restart(t)
+	eventually(t, "both bans to be applied after a restart", func() bool {
+		return fw.Up() && len(fake.Rules("public")) == 2
+	})
+}
+
+func TestFirewalldWatchReconnects(t *testing.T) {
+	retry := fwdRetry
+	fwdRetry = 20 * time.Millisecond
+	t.Cleanup(func() { fwdRetry = retry })
+
+	fwd, fake := newTestFirewalld(t, "", "")
+
+	fw := NewFirewall(10)
+	fw.Backend = fwd
+	fw.Disconnector = &nopDisconnector{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fw.Watch(ctx)
+
+	fw.BanPeer(&xrpl.Peer{Address: "192.0.2.10:51235", PublicKey: "a"})
+
+	// wait for the watch to subscribe, seen by it re-applying the ban after a
+	// reload
+	eventually(t, "the watch to subscribe", func() bool {
+		if err := fake.reload(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		return len(fake.Rules("public")) == 1
+	})
+
+	// the connection to the bus is lost while firewalld loses its runtime
+	// rules, the backend reconnects and re-applies the ban
+	fake.mu.Lock()
+	fake.load()
+	fake.mu.Unlock()
+	fwd.connMu.RLock()
+	conn := fwd.conn
+	fwd.connMu.RUnlock()
+	conn.Close()
+
+	eventually(t, "the ban to be re-applied after reconnecting", func() bool {
+		return fw.Up() && len(fake.Rules("public")) == 1
+	})
+}
+
+func TestToKnownErr(t *testing.T) {
+	var tests = []struct {
+		err, want error
+	}{
+		{nil, nil},
+		{fwdErr(alreadyEnabled, "rule"), errAlreadyEnabled},
+		{fwdErr(notEnabled, "rule"), errNotEnabled},
+	}
+
+	for _, tt := range tests {
+		if got := toKnownErr(tt.err); got != tt.want {
+			t.Errorf("'%v': expected %v got %v", tt.err, tt.want, got)
+		}
+	}
+
+	err := fwdErr("INVALID_ZONE", "dmz")
+	if got := toKnownErr(err); got != error(err) {
+		t.Errorf("'%v' should be returned unchanged, got %v", err, got)
+	}
+}
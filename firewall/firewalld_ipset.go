@@ -0,0 +1,386 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/godbus/dbus"
+)
+
+// https://firewalld.org/documentation/man-pages/firewalld.dbus.html
+const (
+	fwdConfigPath      = "/org/fedoraproject/FirewallD1/config"
+	fwdConfigInterface = "org.fedoraproject.FirewallD1.config"
+)
+
+// ipsetSettings is the (ssssa{ss}as) settings struct accepted by the firewalld
+// config.addIPSet method
+type ipsetSettings struct {
+	Version     string
+	Short       string
+	Description string
+	Type        string
+	Options     map[string]string
+	Entries     []string
+}
+
+// the backend's firewalld ipsets, named for its zone e.g. rbh-public-v4, so
+// backends for different zones do not ban each other's peers
+func (fwd *FirewalldBackend) ipsets() (v4, v6 string) {
+	zone := fwd.Zone
+	if zone == "" {
+		zone = fwd.defaultZone()
+	}
+
+	return "rbh-" + zone + "-v4", "rbh-" + zone + "-v6"
+}
+
+// the firewalld ipset for an IP address
+func (fwd *FirewalldBackend) ipset(ip net.IP) (string, error) {
+	v4, v6 := fwd.ipsets()
+	if ip.To4() != nil {
+		return v4, nil
+	}
+	if ip.To16() != nil {
+		return v6, nil
+	}
+
+	return "", fmt.Errorf("firewalld: invalid IP address '%s'", ip)
+}
+
+// the rich rules taking the action on traffic from members of the ipset, a
+// port scoped action takes more than one
+func ipsetRules(ipset string, v6 bool, action Action) []string {
+	family := "ipv4"
+
+	if v6 {
+		family = "ipv6"
+	}
+
+	rules := make([]string, 0)
+	for _, elements := range action.richActions(v6, ReasonBanned) {
+		rules = append(rules, fmt.Sprintf("rule family='%s' source ipset='%s' %s", family, ipset, elements))
+	}
+
+	return rules
+}
+
+// rich rules referencing the rbh ipsets of a zone
+var ipsetRuleRe = regexp.MustCompile(`source ipset=["']rbh-[\w-]+-v[46]["']`)
+
+// CreateIPSets creates the backend's ipsets if they are missing. firewalld can
+// only create ipsets in the permanent config, so if either is missing from the
+// runtime it is added there and firewalld is reloaded to bring it into the
+// runtime. The reload drops every runtime only rule, so call this once when
+// rbh starts, before any bans are added. Bans never reload firewalld, they fail
+// if the ipsets are missing.
+func (fwd *FirewalldBackend) CreateIPSets() error {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+
+	obj, err := fwd.object()
+	if err != nil {
+		return err
+	}
+
+	missing, err := fwd.missingIPSets(obj)
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+
+	config, err := fwd.objectAt(fwdConfigPath)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	if err := config.Call(fwdConfigInterface+".getIPSetNames", 0).Store(&names); err != nil {
+		return fmt.Errorf("firewalld: cannot list permanent ipsets: %v", err)
+	}
+	permanent := make(map[string]bool)
+	for _, name := range names {
+		permanent[name] = true
+	}
+
+	created := make([]string, 0, len(missing))
+	for name, family := range missing {
+		created = append(created, name)
+		if permanent[name] {
+			continue
+		}
+
+		log.Println("firewalld: creating ipset", name)
+		settings := ipsetSettings{
+			Short:       name,
+			Description: "peers banned by rbh",
+			Type:        ipsetType,
+			Options:     map[string]string{"family": family},
+			Entries:     []string{},
+		}
+
+		var path dbus.ObjectPath
+		err := config.Call(fwdConfigInterface+".addIPSet", 0, name, settings).Store(&path)
+		if err != nil {
+			return fmt.Errorf("firewalld: cannot create ipset '%s': %v", name, err)
+		}
+	}
+
+	sort.Strings(created)
+	log.Println("firewalld: reloading to apply ipsets", strings.Join(created, ", "))
+	log.Println("firewalld: the reload drops every runtime rule which is not in the permanent config")
+	if err := obj.Call(fwdInterface+".reload", 0).Err; err != nil {
+		return fmt.Errorf("firewalld: reload: %v", err)
+	}
+
+	fwd.ready = false
+
+	return nil
+}
+
+// the backend's ipsets missing from the runtime, by name with their family. An
+// error is returned if an ipset exists with another type.
+func (fwd *FirewalldBackend) missingIPSets(obj dbus.BusObject) (map[string]string, error) {
+	var runtime []string
+	if err := obj.Call(fwdInterface+".ipset.getIPSets", 0).Store(&runtime); err != nil {
+		return nil, fmt.Errorf("firewalld: cannot list ipsets: %v", err)
+	}
+
+	v4, v6 := fwd.ipsets()
+	missing := map[string]string{v4: "inet", v6: "inet6"}
+	for _, name := range runtime {
+		if _, ok := missing[name]; !ok {
+			continue
+		}
+		delete(missing, name)
+
+		var settings ipsetSettings
+		err := obj.Call(fwdInterface+".ipset.getIPSetSettings", 0, name).Store(&settings)
+		if err != nil {
+			return nil, fmt.Errorf("firewalld: cannot read ipset '%s': %v", name, err)
+		}
+		if settings.Type != ipsetType {
+			return nil, fmt.Errorf("firewalld: ipset '%s' has type %s not %s", name, settings.Type, ipsetType)
+		}
+	}
+
+	return missing, nil
+}
+
+// ensureIPSets checks the rbh ipsets exist and makes sure the rich rules that
+// reference them do too. The rules are added to the zone, and its permanent
+// config in Permanent mode. Rules left over from a different action are
+// removed. The ipsets are not created here, see CreateIPSets.
+func (fwd *FirewalldBackend) ensureIPSets() error {
+	obj, err := fwd.object()
+	if err != nil {
+		return err
+	}
+
+	missing, err := fwd.missingIPSets(obj)
+	if err != nil {
+		return err
+	}
+	v4, v6 := fwd.ipsets()
+	for _, name := range []string{v4, v6} {
+		if _, ok := missing[name]; ok {
+			return fmt.Errorf("firewalld: ipset '%s' does not exist, it is created when rbh run starts", name)
+		}
+	}
+
+	wanted := make(map[string]bool)
+	for _, rule := range append(ipsetRules(v4, false, fwd.Action), ipsetRules(v6, true, fwd.Action)...) {
+		wanted[rule] = true
+	}
+
+	rules, err := fwd.getRichRules(fwd.Zone)
+	if err != nil {
+		return fmt.Errorf("firewalld: cannot list rich rules: %v", err)
+	}
+	for _, rule := range rules {
+		// firewalld returns rules with double quotes
+		if !ipsetRuleRe.MatchString(rule) || wanted[strings.ReplaceAll(rule, `"`, "'")] {
+			continue
+		}
+		if err := fwd.removeRichRule(fwd.Zone, rule); err != nil && err != errNotEnabled {
+			return err
+		}
+	}
+
+	for rule := range wanted {
+		if fwd.Permanent {
+			if err := ignoreKnown(fwd.addPermanentRichRule(fwd.Zone, rule)); err != nil {
+				return err
+			}
+		}
+
+		err := fwd.addRichRule(fwd.Zone, rule, 0)
+		if err != nil && err != errAlreadyEnabled {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add an entry to an ipset
+func (fwd *FirewalldBackend) addIPSetEntry(ipset, entry string) error {
+	obj, err := fwd.object()
+	if err != nil {
+		return err
+	}
+
+	log.Println(fmt.Sprintf("firewalld: adding %s to ipset %s", entry, ipset))
+
+	return toKnownErr(obj.Call(fwdInterface+".ipset.addEntry", 0, ipset, entry).Err)
+}
+
+// Remove an entry from an ipset
+func (fwd *FirewalldBackend) removeIPSetEntry(ipset, entry string) error {
+	obj, err := fwd.object()
+	if err != nil {
+		return err
+	}
+
+	log.Println(fmt.Sprintf("firewalld: removing %s from ipset %s", entry, ipset))
+
+	return toKnownErr(obj.Call(fwdInterface+".ipset.removeEntry", 0, ipset, entry).Err)
+}
+
+// Retrieve the entries of an ipset
+func (fwd *FirewalldBackend) getIPSetEntries(ipset string) ([]string, error) {
+	obj, err := fwd.object()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	err = obj.Call(fwdInterface+".ipset.getEntries", 0, ipset).Store(&entries)
+
+	return entries, err
+}
+
+// prepare the ipsets once, or again after a reload
+func (fwd *FirewalldBackend) ensureReady(force bool) error {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+
+	if fwd.ready && !force {
+		return nil
+	}
+
+	fwd.ready = false
+	if err := fwd.ensureIPSets(); err != nil {
+		return err
+	}
+	fwd.ready = true
+
+	return nil
+}
+
+func (fwd *FirewalldBackend) banIPSet(ban *Ban) error {
+	ipset, err := fwd.ipset(ban.IP)
+	if err != nil {
+		return err
+	}
+
+	if err := fwd.ensureReady(false); err != nil {
+		return err
+	}
+
+	if fwd.Permanent {
+		if err := ignoreKnown(fwd.addPermanentIPSetEntry(ipset, ban.CIDR())); err != nil {
+			return err
+		}
+	}
+
+	err = fwd.addIPSetEntry(ipset, ban.CIDR())
+	if err == errAlreadyEnabled {
+		return nil
+	}
+
+	return err
+}
+
+func (fwd *FirewalldBackend) unbanIPSet(ban *Ban) error {
+	ipset, err := fwd.ipset(ban.IP)
+	if err != nil {
+		return err
+	}
+
+	if fwd.Permanent {
+		if err := ignoreKnown(fwd.removePermanentIPSetEntry(ipset, ban.CIDR())); err != nil && !noIPSet(err) {
+			return err
+		}
+	}
+
+	err = fwd.removeIPSetEntry(ipset, ban.CIDR())
+	if err == errNotEnabled || noIPSet(err) {
+		return nil
+	}
+
+	return err
+}
+
+// the ipsets are only created by rbh run with IPSet set, so there may be no
+// ipset to remove an entry from
+func noIPSet(err error) bool {
+	return err != nil && strings.Contains(err.Error(), invalidIPSet)
+}
+
+func (fwd *FirewalldBackend) listIPSet() ([]*Ban, error) {
+	bans := make([]*Ban, 0)
+	v4, v6 := fwd.ipsets()
+	for _, ipset := range []string{v4, v6} {
+		entries, err := fwd.getIPSetEntries(ipset)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if network, err := parseSource(entry); err == nil {
+				prefix, _ := network.Mask.Size()
+				bans = append(bans, &Ban{IP: network.IP, Prefix: prefix})
+			}
+		}
+	}
+
+	return bans, nil
+}
+
+func (fwd *FirewalldBackend) reconcileIPSet(bans []*Ban) error {
+	if err := fwd.ensureReady(true); err != nil {
+		return err
+	}
+
+	for _, ban := range bans {
+		if ban.Timeout() <= 0 {
+			continue
+		}
+
+		if err := fwd.banIPSet(ban); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/godbus/dbus"
+)
+
+const (
+	fwdConfigZoneInterface  = fwdConfigInterface + ".zone"
+	fwdConfigIPSetInterface = fwdConfigInterface + ".ipset"
+)
+
+// the permanent config object of a zone or ipset, found with the config
+// getZoneByName or getIPSetByName method
+func (fwd *FirewalldBackend) configObject(method, name string) (dbus.BusObject, error) {
+	config, err := fwd.objectAt(fwdConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var path dbus.ObjectPath
+	if err := config.Call(fwdConfigInterface+"."+method, 0, name).Store(&path); err != nil {
+		return nil, fmt.Errorf("firewalld: cannot find '%s' in the permanent config: %v", name, err)
+	}
+
+	return fwd.objectAt(path)
+}
+
+// Insert a rich rule in the permanent config of a zone, permanent rules
+// cannot have a timeout
+func (fwd *FirewalldBackend) addPermanentRichRule(zone, rule string) error {
+	if zone == "" {
+		zone = fwd.defaultZone()
+	}
+
+	obj, err := fwd.configObject("getZoneByName", zone)
+	if err != nil {
+		return err
+	}
+
+	log.Println(fmt.Sprintf("firewalld: adding permanent rule (%s) to %s zone", rule, zone))
+
+	return toKnownErr(obj.Call(fwdConfigZoneInterface+".addRichRule", 0, rule).Err)
+}
+
+// Remove a rich rule from the permanent config of a zone
+func (fwd *FirewalldBackend) removePermanentRichRule(zone, rule string) error {
+	if zone == "" {
+		zone = fwd.defaultZone()
+	}
+
+	obj, err := fwd.configObject("getZoneByName", zone)
+	if err != nil {
+		return err
+	}
+
+	log.Println(fmt.Sprintf("firewalld: removing permanent rule (%s) from %s zone", rule, zone))
+
+	return toKnownErr(obj.Call(fwdConfigZoneInterface+".removeRichRule", 0, rule).Err)
+}
+
+// Retrieve the rich rules in the permanent config of a zone
+func (fwd *FirewalldBackend) getPermanentRichRules(zone string) ([]string, error) {
+	if zone == "" {
+		zone = fwd.defaultZone()
+	}
+
+	obj, err := fwd.configObject("getZoneByName", zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []string
+	err = obj.Call(fwdConfigZoneInterface+".getRichRules", 0).Store(&rules)
+
+	return rules, err
+}
+
+// Add an entry to the permanent config of an ipset
+func (fwd *FirewalldBackend) addPermanentIPSetEntry(ipset, entry string) error {
+	obj, err := fwd.configObject("getIPSetByName", ipset)
+	if err != nil {
+		return err
+	}
+
+	log.Println(fmt.Sprintf("firewalld: adding %s to permanent ipset %s", entry, ipset))
+
+	return toKnownErr(obj.Call(fwdConfigIPSetInterface+".addEntry", 0, entry).Err)
+}
+
+// Remove an entry from the permanent config of an ipset
+func (fwd *FirewalldBackend) removePermanentIPSetEntry(ipset, entry string) error {
+	obj, err := fwd.configObject("getIPSetByName", ipset)
+	if err != nil {
+		return err
+	}
+
+	log.Println(fmt.Sprintf("firewalld: removing %s from permanent ipset %s", entry, ipset))
+
+	return toKnownErr(obj.Call(fwdConfigIPSetInterface+".removeEntry", 0, entry).Err)
+}
+
+// ignore errors for rules or entries that are already in the state wanted
+func ignoreKnown(err error) error {
+	if err == errAlreadyEnabled || err == errNotEnabled {
+		return nil
+	}
+
+	return err
+}
@@ -1,7 +1,9 @@
 package firewall
 
 import (
+	"net"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -32,7 +34,7 @@ func genBlackList() *blacklist {
 
 	for i := 0; i < 10; i++ {
 		p := &xrpl.Peer{PublicKey: strconv.Itoa(i)}
-		bl.add(p)
+		bl.add(p, "test")
 	}
 
 	return bl
@@ -60,6 +62,9 @@ var wlTests = []struct {
 
 func TestWhitelistedPeerIgnored(t *testing.T) {
 	fw := NewFirewall(10, "10.0.0.10", "10.0.0.20", "10.0.0.30")
+	mb := NewMemoryBackend("drop")
+	fw.Backend = mb
+	fw.Disconnector = &nopDisconnector{}
 
 	for _, tt := range wlTests {
 		fw.BanPeer(&xrpl.Peer{Address: tt.ip + ":1234", PublicKey: "x"})
@@ -68,4 +73,157 @@ func TestWhitelistedPeerIgnored(t *testing.T) {
 	if len(fw.blacklist.entries) > 2 || len(fw.blacklist.entries) == 0 {
 		t.Fatalf("unexpected number of blacklist entries '%d'", len(fw.blacklist.entries))
 	}
+
+	for _, rule := range mb.History() {
+		if rule.Ban.IP.String() == "10.0.0.20" {
+			t.Fatalf("whitelisted peer was banned: %+v", rule)
+		}
+	}
+	if len(mb.Rules()) != 2 {
+		t.Fatalf("unexpected number of rules '%d'", len(mb.Rules()))
+	}
+}
+
+func TestUnconnectedFirewall(t *testing.T) {
+	fw := NewFirewall(10)
+	fw.Disconnector = &nopDisconnector{}
+
+	if fw.Up() {
+		t.Fatal("expected an unconnected firewalld backend to be down")
+	}
+	if err := fw.Backend.Ban(NewBan(net.ParseIP("192.0.2.10"), time.Minute)); err != errNotRunning {
+		t.Fatalf("unexpected error banning while unconnected: %v", err)
+	}
+
+	fw.BanPeer(&xrpl.Peer{Address: "192.0.2.10:51235", PublicKey: "x"})
+	if !fw.blacklist.contains(&xrpl.Peer{PublicKey: "x"}) {
+		t.Fatal("expected the peer to be blacklisted")
+	}
+
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+}
+
+var richRuleTests = []struct {
+	source, drop string
+}{
+	{"192.0.2.10", "rule family='ipv4' source address='192.0.2.10/32' log prefix='rbh:old-version' drop"},
+	{"192.0.2.0/24", "rule family='ipv4' source address='192.0.2.0/24' log prefix='rbh:old-version' drop"},
+	{"2001:db8::10", "rule family='ipv6' source address='2001:db8::10/128' log prefix='rbh:old-version' drop"},
+	{"2001:db8:1:2::/64", "rule family='ipv6' source address='2001:db8:1:2::/64' log prefix='rbh:old-version' drop"},
+}
+
+func TestRichRuleSource(t *testing.T) {
+	for _, tt := range richRuleTests {
+		rules, err := newRichRules(tt.source, Action{}, "old-version", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rules) != 1 {
+			t.Fatalf("expected one rule for %s, got %v", tt.source, rules)
+		}
+		drop := rules[0]
+		if drop.String() != tt.drop {
+			t.Errorf("unexpected rule for %s: %s", tt.source, drop)
+		}
+
+		ban := parseRichRule(drop.String())
+		if ban == nil || ban.CIDR() != drop.source.String() || ban.Reason != "old-version" {
+			t.Errorf("rule for %s parsed as %v", tt.source, ban)
+		}
+	}
+}
+
+var ownedRuleTests = []struct {
+	rule  string
+	owned bool
+}{
+	{`rule family="ipv4" source address="192.0.2.10" drop`, false},
+	{`rule family="ipv4" source address="192.0.2.10" log prefix="audit" drop`, false},
+	{`rule family="ipv4" source address="192.0.2.10" log prefix="rbh:manual" level="warning" drop`, true},
+	{`rule family="ipv4" source address="192.0.2.10" log prefix="rbh:sanity-insane" limit value="10/m" reject`, true},
+	// a tarpit as firewalld lists it
+	{`rule family="ipv4" source address="192.0.2.10/32" forward-port port="51235" protocol="tcp" to-port="2222" log prefix="rbh:banned" level="warning"`, true},
+	{`rule family="ipv4" source address="192.0.2.10/32" forward-port port="51235" protocol="tcp" to-port="2222"`, false},
+}
+
+func TestRichRuleOwned(t *testing.T) {
+	for _, tt := range ownedRuleTests {
+		if owned := parseRichRule(tt.rule) != nil; owned != tt.owned {
+			t.Errorf("expected owned %t for %s", tt.owned, tt.rule)
+		}
+	}
+}
+
+var actionTests = []struct {
+	action Action
+	v4, v6 []string
+}{
+	{Action{}, []string{"log prefix='rbh:banned' drop"}, []string{"log prefix='rbh:banned' drop"}},
+	{Action{Type: ActionReject}, []string{"log prefix='rbh:banned' reject"}, []string{"log prefix='rbh:banned' reject"}},
+	{
+		Action{Type: ActionReject, RejectWith: "icmp-host-prohibited", RejectWith6: "icmp6-adm-prohibited"},
+		[]string{"log prefix='rbh:banned' reject type='icmp-host-prohibited'"},
+		[]string{"log prefix='rbh:banned' reject type='icmp6-adm-prohibited'"},
+	},
+	{
+		Action{PortOnly: true},
+		[]string{
+			"port port='51235' protocol='tcp' log prefix='rbh:banned' drop",
+			"source-port port='51235' protocol='tcp' log prefix='rbh:banned' drop",
+		},
+		[]string{
+			"port port='51235' protocol='tcp' log prefix='rbh:banned' drop",
+			"source-port port='51235' protocol='tcp' log prefix='rbh:banned' drop",
+		},
+	},
+	{
+		Action{Type: ActionReject, RejectWith: "icmp-host-prohibited", Port: 6000, PortOnly: true},
+		[]string{
+			"port port='6000' protocol='tcp' log prefix='rbh:banned' reject type='icmp-host-prohibited'",
+			"source-port port='6000' protocol='tcp' log prefix='rbh:banned' reject type='icmp-host-prohibited'",
+		},
+		[]string{
+			"port port='6000' protocol='tcp' log prefix='rbh:banned' reject",
+			"source-port port='6000' protocol='tcp' log prefix='rbh:banned' reject",
+		},
+	},
+	{
+		Action{Type: ActionTarpit, ToPort: 2222, Port: 6000, PortOnly: true},
+		[]string{"forward-port port='6000' protocol='tcp' to-port='2222' log prefix='rbh:banned'"},
+		[]string{"forward-port port='6000' protocol='tcp' to-port='2222' log prefix='rbh:banned'"},
+	},
+	{
+		Action{LogLimit: "10/m"},
+		[]string{"log prefix='rbh:banned' limit value='10/m' drop"},
+		[]string{"log prefix='rbh:banned' limit value='10/m' drop"},
+	},
+	{
+		Action{Type: ActionTarpit, ToPort: 2222},
+		[]string{"forward-port port='51235' protocol='tcp' to-port='2222' log prefix='rbh:banned'"},
+		[]string{"forward-port port='51235' protocol='tcp' to-port='2222' log prefix='rbh:banned'"},
+	},
+}
+
+func TestRichRuleAction(t *testing.T) {
+	for _, tt := range actionTests {
+		for source, expected := range map[string][]string{"192.0.2.10": tt.v4, "2001:db8::10": tt.v6} {
+			rules, err := newRichRules(source, tt.action, ReasonBanned, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rules) != len(expected) {
+				t.Fatalf("expected %d %s rules, got %v", len(expected), tt.action, rules)
+			}
+			for i, rule := range rules {
+				if !strings.HasSuffix(rule.String(), "' "+expected[i]) {
+					t.Errorf("expected %s rule to end with %s, got %s", tt.action, expected[i], rule)
+				}
+				if parseRichRule(strings.ReplaceAll(rule.String(), "'", `"`)) == nil {
+					t.Errorf("%s rule not recognised: %s", tt.action, rule)
+				}
+			}
+		}
+	}
 }
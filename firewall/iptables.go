@@ -0,0 +1,397 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	iptTable    = "filter"
+	iptNATTable = "nat"
+	iptInput    = "INPUT"
+	iptPrerout  = "PREROUTING"
+	iptChain    = "RBH"
+	ipsetV4     = "rbh-v4"
+	ipsetV6     = "rbh-v6"
+	ipsetType   = "hash:net"
+	ipsetMaxTO  = 2147483 // the largest timeout in seconds the kernel accepts
+)
+
+// a single address family managed by the iptables backend
+type iptFamily struct {
+	ipt    *iptables.IPTables
+	set    string
+	family uint8
+}
+
+// the filter and nat rules in the RBH chains logging and taking the action on
+// members of the set
+func (f *iptFamily) rules(action Action) (filter, nat [][]string) {
+	match := []string{"-m", "set", "--match-set", f.set, "src"}
+	switch {
+	case action.kind() == ActionTarpit:
+		match = append([]string{"-p", "tcp", "--dport", strconv.Itoa(action.port())}, match...)
+	case action.scoped():
+		// the source port too, for replies on outbound connections
+		match = append([]string{"-p", "tcp", "-m", "multiport", "--ports", strconv.Itoa(action.port())}, match...)
+	}
+
+	logged := append([]string{}, match...)
+	if action.LogLimit != "" {
+		logged = append(logged, "-m", "limit", "--limit", action.LogLimit)
+	}
+	logged = append(logged, "-j", "LOG", "--log-prefix", logPrefix(ReasonBanned)+" ")
+
+	switch action.kind() {
+	case ActionReject:
+		rule := append(match, "-j", "REJECT")
+		if with := action.rejectWith(f.family == unix.NFPROTO_IPV6); with != "" {
+			rule = append(rule, "--reject-with", with)
+		}
+		filter = append(filter, logged, rule)
+	case ActionTarpit:
+		rule := append(match, "-j", "REDIRECT", "--to-ports", strconv.Itoa(action.ToPort))
+		nat = append(nat, logged, rule)
+	default:
+		filter = append(filter, logged, append(match, "-j", "DROP"))
+	}
+
+	return filter, nat
+}
+
+// ensure the ipset, the RBH chains, the rules taking the action on members of
+// the set and the jumps to the chains all exist, re-creating any that have
+// gone missing
+func (f *iptFamily) ensure(action Action) error {
+	if result, err := netlink.IpsetList(f.set); err == nil {
+		if result.TypeName != ipsetType {
+			return fmt.Errorf("iptables: ipset '%s' has type %s not %s", f.set, result.TypeName, ipsetType)
+		}
+	} else {
+		log.Println("iptables: creating ipset", f.set)
+		timeout := uint32(0)
+		err = netlink.IpsetCreate(f.set, ipsetType, netlink.IpsetCreateOptions{
+			Timeout: &timeout,
+			Family:  f.family,
+		})
+		if err != nil {
+			return fmt.Errorf("iptables: cannot create ipset '%s': %v", f.set, err)
+		}
+	}
+
+	filter, nat := f.rules(action)
+	if err := f.ensureChain(iptTable, iptInput, filter); err != nil {
+		return err
+	}
+
+	return f.ensureChain(iptNATTable, iptPrerout, nat)
+}
+
+// ensure the RBH chain in the table holds exactly the rules and is jumped to
+// from the built in chain. A chain with no rules is only emptied, it is not
+// created.
+func (f *iptFamily) ensureChain(table, builtin string, rules [][]string) error {
+	exists, err := f.ipt.ChainExists(table, iptChain)
+	if err != nil {
+		return fmt.Errorf("iptables: %v", err)
+	}
+
+	if len(rules) == 0 {
+		if exists {
+			return f.ipt.ClearChain(table, iptChain)
+		}
+		return nil
+	}
+
+	if !exists {
+		log.Println("iptables: creating chain", iptChain, "in table", table)
+		if err := f.ipt.NewChain(table, iptChain); err != nil {
+			return fmt.Errorf("iptables: %v", err)
+		}
+	}
+
+	current, err := f.ipt.List(table, iptChain)
+	if err != nil {
+		return fmt.Errorf("iptables: %v", err)
+	}
+
+	// the listing includes the -N for the chain itself
+	rebuild := len(current) != len(rules)+1
+	for _, rule := range rules {
+		if rebuild {
+			break
+		}
+		if ok, err := f.ipt.Exists(table, iptChain, rule...); err != nil || !ok {
+			rebuild = true
+		}
+	}
+
+	if rebuild {
+		if err := f.ipt.ClearChain(table, iptChain); err != nil {
+			return fmt.Errorf("iptables: %v", err)
+		}
+		for _, rule := range rules {
+			if err := f.ipt.Append(table, iptChain, rule...); err != nil {
+				return fmt.Errorf("iptables: %v", err)
+			}
+		}
+	}
+
+	if err := f.ipt.InsertUnique(table, builtin, 1, "-j", iptChain); err != nil {
+		return fmt.Errorf("iptables: %v", err)
+	}
+
+	return nil
+}
+
+// check the ipset exists and the RBH chain taking the action is jumped to,
+// without changing anything
+func (f *iptFamily) check(action Action) error {
+	if _, err := netlink.IpsetList(f.set); err != nil {
+		return fmt.Errorf("iptables: ipset '%s' unavailable: %v", f.set, err)
+	}
+
+	table, builtin := iptTable, iptInput
+	if action.kind() == ActionTarpit {
+		table, builtin = iptNATTable, iptPrerout
+	}
+
+	ok, err := f.ipt.Exists(table, builtin, "-j", iptChain)
+	if err != nil {
+		return fmt.Errorf("iptables: %v", err)
+	}
+	if !ok {
+		return fmt.Errorf("iptables: chain %s is not jumped to from %s in table %s", iptChain, builtin, table)
+	}
+
+	return nil
+}
+
+// IptablesBackend enforces bans with iptables/ip6tables and ipset, for systems
+// without firewalld or nftables. Banned peers are added to the rbh-v4 or rbh-v6
+// `hash:net` ipset with a timeout, and a dedicated RBH chain jumped to from
+// INPUT drops traffic from members of either set. This is similar to the
+// following:
+//
+//	ipset create rbh-v4 hash:net family inet timeout 0
+//	iptables -N RBH
+//	iptables -A RBH -m set --match-set rbh-v4 src -j LOG --log-prefix "rbh:banned "
+//	iptables -A RBH -m set --match-set rbh-v4 src -j DROP
+//	iptables -I INPUT 1 -j RBH
+//
+// The DROP target is replaced by REJECT if the Action rejects, and a port
+// scoped Action only matches `-p tcp -m multiport --ports 51235`, traffic to
+// or from the peer port. A tarpit instead redirects the peer port from a RBH
+// chain in the nat table, e.g.
+//
+//	iptables -t nat -A RBH -p tcp --dport 51235 -m set --match-set rbh-v4 src -j LOG --log-prefix "rbh:banned "
+//	iptables -t nat -A RBH -p tcp --dport 51235 -m set --match-set rbh-v4 src -j REDIRECT --to-ports 2222
+//	iptables -t nat -I PREROUTING 1 -j RBH
+//
+// The LOG rules are rate limited by the Action's LogLimit, if set.
+//
+// The chain, rules and sets are re-created by Reconcile if they have been
+// removed, e.g. by an `iptables -F` or `ipset destroy`, until then Health
+// returns an error.
+//
+// Needless to say, this requires root or CAP_NET_ADMIN.
+type IptablesBackend struct {
+	mu     sync.Mutex
+	action Action
+	v4     *iptFamily
+	v6     *iptFamily
+}
+
+// NewIptablesBackend returns a Backend using iptables and ipset which takes the
+// action on banned sources, the chains and sets are created if they do not
+// already exist
+func NewIptablesBackend(action Action) (*IptablesBackend, error) {
+	ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return nil, fmt.Errorf("iptables: %v", err)
+	}
+
+	ipt6, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	if err != nil {
+		return nil, fmt.Errorf("ip6tables: %v", err)
+	}
+
+	ipb := &IptablesBackend{
+		action: action,
+		v4:     &iptFamily{ipt: ipt4, set: ipsetV4, family: unix.NFPROTO_IPV4},
+		v6:     &iptFamily{ipt: ipt6, set: ipsetV6, family: unix.NFPROTO_IPV6},
+	}
+
+	if err := ipb.ensure(); err != nil {
+		return nil, err
+	}
+
+	return ipb, nil
+}
+
+// the address family responsible for an IP address
+func (ipb *IptablesBackend) family(ip net.IP) (*iptFamily, error) {
+	if ip.To4() != nil {
+		return ipb.v4, nil
+	}
+	if ip.To16() != nil {
+		return ipb.v6, nil
+	}
+
+	return nil, fmt.Errorf("iptables: invalid IP address '%s'", ip)
+}
+
+// Ban adds the source to the ipset with the time remaining on the ban
+func (ipb *IptablesBackend) Ban(ban *Ban) error {
+	f, err := ipb.family(ban.IP)
+	if err != nil {
+		return err
+	}
+
+	ipb.mu.Lock()
+	defer ipb.mu.Unlock()
+
+	network := ban.Net()
+	prefix, _ := network.Mask.Size()
+	entry := &netlink.IPSetEntry{IP: network.IP, CIDR: uint8(prefix), Replace: true}
+	if timeout := ban.Timeout(); timeout > 0 {
+		seconds := uint32(timeout.Seconds())
+		if seconds > ipsetMaxTO {
+			seconds = ipsetMaxTO
+		}
+		entry.Timeout = &seconds
+	}
+
+	log.Println(fmt.Sprintf("iptables: adding %s to ipset %s", ban.CIDR(), f.set))
+
+	if err := netlink.IpsetAdd(f.set, entry); err != nil {
+		return fmt.Errorf("iptables: %v", err)
+	}
+
+	return nil
+}
+
+// Unban removes the source from the ipset
+func (ipb *IptablesBackend) Unban(ban *Ban) error {
+	f, err := ipb.family(ban.IP)
+	if err != nil {
+		return err
+	}
+
+	ipb.mu.Lock()
+	defer ipb.mu.Unlock()
+
+	network := ban.Net()
+	prefix, _ := network.Mask.Size()
+	entry := &netlink.IPSetEntry{IP: network.IP, CIDR: uint8(prefix)}
+	if found, err := netlink.IpsetTest(f.set, entry); err != nil || !found {
+		return err
+	}
+
+	log.Println(fmt.Sprintf("iptables: removing %s from ipset %s", ban.CIDR(), f.set))
+
+	if err := netlink.IpsetDel(f.set, entry); err != nil {
+		return fmt.Errorf("iptables: %v", err)
+	}
+
+	return nil
+}
+
+// List returns the members of both ipsets along with the time the kernel has
+// left on each entry
+func (ipb *IptablesBackend) List() ([]*Ban, error) {
+	ipb.mu.Lock()
+	defer ipb.mu.Unlock()
+
+	bans := make([]*Ban, 0)
+	for _, f := range []*iptFamily{ipb.v4, ipb.v6} {
+		result, err := netlink.IpsetList(f.set)
+		if err != nil {
+			return nil, fmt.Errorf("iptables: ipset '%s': %v", f.set, err)
+		}
+
+		for _, entry := range result.Entries {
+			ban := &Ban{IP: entry.IP, Prefix: int(entry.CIDR)}
+			if entry.Timeout != nil && *entry.Timeout > 0 {
+				ban.Expires = time.Now().Add(time.Duration(*entry.Timeout) * time.Second)
+			}
+			bans = append(bans, ban)
+		}
+	}
+
+	return bans, nil
+}
+
+// Reconcile re-creates anything that has gone missing and re-adds the bans
+// with the time remaining on each
+func (ipb *IptablesBackend) Reconcile(bans []*Ban) error {
+	if err := ipb.ensure(); err != nil {
+		return err
+	}
+
+	for _, ban := range bans {
+		if ban.Timeout() <= 0 {
+			continue
+		}
+
+		if err := ipb.Ban(ban); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+// ensure the chains and sets exist for both address families, re-creating any
+// that have gone missing
+func (ipb *IptablesBackend) ensure() error {
+	ipb.mu.Lock()
+	defer ipb.mu.Unlock()
+
+	for _, f := range []*iptFamily{ipb.v4, ipb.v6} {
+		if err := f.ensure(ipb.action); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Health returns an error if the chain or set of either address family is
+// missing, it does not re-create them, see Reconcile
+func (ipb *IptablesBackend) Health() error {
+	ipb.mu.Lock()
+	defer ipb.mu.Unlock()
+
+	for _, f := range []*iptFamily{ipb.v4, ipb.v6} {
+		if err := f.check(ipb.action); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
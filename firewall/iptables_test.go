@@ -0,0 +1,134 @@
+package firewall
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+var (
+	iptV4 = &iptFamily{set: ipsetV4, family: unix.NFPROTO_IPV4}
+	iptV6 = &iptFamily{set: ipsetV6, family: unix.NFPROTO_IPV6}
+)
+
+var iptRuleTests = []struct {
+	family *iptFamily
+	action Action
+	filter []string
+	nat    []string
+}{
+	{
+		iptV4, Action{},
+		[]string{
+			"-m set --match-set rbh-v4 src -j LOG --log-prefix rbh:banned_",
+			"-m set --match-set rbh-v4 src -j DROP",
+		},
+		nil,
+	},
+	{
+		iptV6, Action{},
+		[]string{
+			"-m set --match-set rbh-v6 src -j LOG --log-prefix rbh:banned_",
+			"-m set --match-set rbh-v6 src -j DROP",
+		},
+		nil,
+	},
+	{
+		iptV4, Action{PortOnly: true},
+		[]string{
+			"-p tcp -m multiport --ports 51235 -m set --match-set rbh-v4 src -j LOG --log-prefix rbh:banned_",
+			"-p tcp -m multiport --ports 51235 -m set --match-set rbh-v4 src -j DROP",
+		},
+		nil,
+	},
+	{
+		iptV6, Action{Port: 51000, PortOnly: true, LogLimit: "10/m"},
+		[]string{
+			"-p tcp -m multiport --ports 51000 -m set --match-set rbh-v6 src -m limit --limit 10/m -j LOG --log-prefix rbh:banned_",
+			"-p tcp -m multiport --ports 51000 -m set --match-set rbh-v6 src -j DROP",
+		},
+		nil,
+	},
+	{
+		iptV4, Action{Type: ActionReject},
+		[]string{
+			"-m set --match-set rbh-v4 src -j LOG --log-prefix rbh:banned_",
+			"-m set --match-set rbh-v4 src -j REJECT",
+		},
+		nil,
+	},
+	{
+		iptV4, Action{Type: ActionReject, RejectWith: "icmp-host-prohibited", RejectWith6: "icmp6-adm-prohibited", PortOnly: true},
+		[]string{
+			"-p tcp -m multiport --ports 51235 -m set --match-set rbh-v4 src -j LOG --log-prefix rbh:banned_",
+			"-p tcp -m multiport --ports 51235 -m set --match-set rbh-v4 src -j REJECT --reject-with icmp-host-prohibited",
+		},
+		nil,
+	},
+	{
+		iptV6, Action{Type: ActionReject, RejectWith: "icmp-host-prohibited", RejectWith6: "icmp6-adm-prohibited"},
+		[]string{
+			"-m set --match-set rbh-v6 src -j LOG --log-prefix rbh:banned_",
+			"-m set --match-set rbh-v6 src -j REJECT --reject-with icmp6-adm-prohibited",
+		},
+		nil,
+	},
+	{
+		iptV4, Action{Type: ActionTarpit, ToPort: 2222},
+		nil,
+		[]string{
+			"-p tcp --dport 51235 -m set --match-set rbh-v4 src -j LOG --log-prefix rbh:banned_",
+			"-p tcp --dport 51235 -m set --match-set rbh-v4 src -j REDIRECT --to-ports 2222",
+		},
+	},
+	{
+		iptV6, Action{Type: ActionTarpit, ToPort: 2222, PortOnly: true},
+		nil,
+		[]string{
+			"-p tcp --dport 51235 -m set --match-set rbh-v6 src -j LOG --log-prefix rbh:banned_",
+			"-p tcp --dport 51235 -m set --match-set rbh-v6 src -j REDIRECT --to-ports 2222",
+		},
+	},
+}
+
+// the rules joined by spaces, with the trailing space of the log prefix shown
+// as an underscore
+func joinRules(rules [][]string) []string {
+	var joined []string
+	for _, rule := range rules {
+		joined = append(joined, strings.Replace(strings.Join(rule, " "), "banned ", "banned_", 1))
+	}
+
+	return joined
+}
+
+func TestIptablesRules(t *testing.T) {
+	for _, tt := range iptRuleTests {
+		filter, nat := tt.family.rules(tt.action)
+
+		if got := joinRules(filter); !reflect.DeepEqual(got, tt.filter) {
+			t.Errorf("%s %+v: expected filter rules\n%q\ngot\n%q", tt.family.set, tt.action, tt.filter, got)
+		}
+		if got := joinRules(nat); !reflect.DeepEqual(got, tt.nat) {
+			t.Errorf("%s %+v: expected nat rules\n%q\ngot\n%q", tt.family.set, tt.action, tt.nat, got)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Operations recorded by the MemoryBackend
+const (
+	MemoryBan       = "ban"
+	MemoryUnban     = "unban"
+	MemoryReconcile = "reconcile"
+)
+
+// MemoryRule is a ban as it was applied to a MemoryBackend
+type MemoryRule struct {
+	Op      string
+	Zone    string
+	Action  Action
+	Timeout time.Duration
+	Ban     Ban
+}
+
+// MemoryBackend is a Backend which keeps bans in memory rather than enforcing
+// them. It records every rule applied so tests can assert exactly what the
+// Firewall asked for, and it can be used by programs embedding the firewall
+// package that want to enforce bans some other way. Bans time out the way
+// they would in the kernel.
+type MemoryBackend struct {
+	// Zone and Action are recorded against each rule applied
+	Zone   string
+	Action Action
+
+	mu      sync.Mutex
+	err     error
+	active  map[string]*MemoryRule
+	history []MemoryRule
+}
+
+// NewMemoryBackend returns an empty MemoryBackend recording rules against the
+// zone
+func NewMemoryBackend(zone string) *MemoryBackend {
+	return &MemoryBackend{
+		Zone:   zone,
+		active: make(map[string]*MemoryRule),
+	}
+}
+
+func (mb *MemoryBackend) record(op string, ban *Ban) *MemoryRule {
+	rule := MemoryRule{Op: op, Zone: mb.Zone, Action: mb.Action, Timeout: ban.Timeout(), Ban: *ban}
+	mb.history = append(mb.history, rule)
+
+	return &rule
+}
+
+// the active rules that have not timed out, the caller holds the lock
+func (mb *MemoryBackend) current() []*MemoryRule {
+	rules := make([]*MemoryRule, 0, len(mb.active))
+	for key, rule := range mb.active {
+		if !rule.Ban.Expires.IsZero() && rule.Ban.Timeout() == 0 {
+			delete(mb.active, key)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Ban.CIDR() < rules[j].Ban.CIDR()
+	})
+
+	return rules
+}
+
+// Ban records the ban and makes it active
+func (mb *MemoryBackend) Ban(ban *Ban) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.err != nil {
+		return mb.err
+	}
+
+	mb.active[ban.CIDR()] = mb.record(MemoryBan, ban)
+
+	return nil
+}
+
+// Unban records the unban and removes any active ban for the source
+func (mb *MemoryBackend) Unban(ban *Ban) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.err != nil {
+		return mb.err
+	}
+
+	mb.record(MemoryUnban, ban)
+	delete(mb.active, ban.CIDR())
+
+	return nil
+}
+
+// List returns the active bans
+func (mb *MemoryBackend) List() ([]*Ban, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.err != nil {
+		return nil, mb.err
+	}
+
+	bans := make([]*Ban, 0, len(mb.active))
+	for _, rule := range mb.current() {
+		ban := rule.Ban
+		bans = append(bans, &ban)
+	}
+
+	return bans, nil
+}
+
+// Reconcile records and re-activates each ban with time remaining
+func (mb *MemoryBackend) Reconcile(bans []*Ban) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.err != nil {
+		return mb.err
+	}
+
+	for _, ban := range bans {
+		if ban.Timeout() <= 0 {
+			continue
+		}
+		mb.active[ban.CIDR()] = mb.record(MemoryReconcile, ban)
+	}
+
+	return nil
+}
+
+// Health returns the error set with SetHealth
+func (mb *MemoryBackend) Health() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	return mb.err
+}
+
+// SetHealth simulates the backend becoming unavailable, while the error is set
+// every call fails with it. Pass nil to bring the backend back.
+func (mb *MemoryBackend) SetHealth(err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.err = err
+}
+
+// Rules returns the rules currently active, ordered by source network
+func (mb *MemoryBackend) Rules() []MemoryRule {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	rules := make([]MemoryRule, 0, len(mb.active))
+	for _, rule := range mb.current() {
+		rules = append(rules, *rule)
+	}
+
+	return rules
+}
+
+// History returns every rule applied to the backend in the order they were
+// applied
+func (mb *MemoryBackend) History() []MemoryRule {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	return append([]MemoryRule(nil), mb.history...)
+}
+
+// Reset clears the active rules and history
+func (mb *MemoryBackend) Reset() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.active = make(map[string]*MemoryRule)
+	mb.history = nil
+}
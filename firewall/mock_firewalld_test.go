@@ -0,0 +1,660 @@
+package firewall
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// a bus which allows anyone to own any name and call any method
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startBus runs a private dbus-daemon for the test and points the system bus
+// address at it, the test is skipped if dbus-daemon is not installed
+func startBus(t *testing.T) string {
+	t.Helper()
+
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	if err := os.WriteFile(config, []byte(fmt.Sprintf(busConfig, filepath.Join(dir, "bus"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("dbus-daemon: %v", err)
+	}
+	address = strings.TrimSpace(address)
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", address)
+
+	return address
+}
+
+// fakeFirewalld stands in for firewalld on a bus started by startBus. It
+// implements the zone, ipset and permanent config methods the backend uses,
+// returns the same ALREADY_ENABLED and NOT_ENABLED errors and emits Reloaded.
+// Like firewalld a reload replaces the runtime with the permanent config.
+type fakeFirewalld struct {
+	mu      sync.Mutex
+	address string
+	conn    *dbus.Conn
+
+	// rich rules and their timeout by zone
+	rules          map[string]map[string]int32
+	permanentRules map[string]map[string]int32
+	// interfaces bound to a zone
+	interfaces map[string]string
+	// ipset entries by set
+	ipsets          map[string]map[string]bool
+	permanentIPSets map[string]map[string]bool
+	settings        map[string]ipsetSettings
+	// the number of times firewalld has been reloaded
+	reloads int
+}
+
+// newFakeFirewalld starts a bus and firewalld on it with the public and
+// internal zones, eth1 is in the internal zone
+func newFakeFirewalld(t *testing.T) *fakeFirewalld {
+	t.Helper()
+
+	fake := &fakeFirewalld{
+		address: startBus(t),
+		rules: map[string]map[string]int32{
+			"public":   make(map[string]int32),
+			"internal": make(map[string]int32),
+		},
+		permanentRules: map[string]map[string]int32{
+			"public":   make(map[string]int32),
+			"internal": make(map[string]int32),
+		},
+		interfaces:      map[string]string{"eth1": "internal"},
+		ipsets:          make(map[string]map[string]bool),
+		permanentIPSets: make(map[string]map[string]bool),
+		settings:        make(map[string]ipsetSettings),
+	}
+
+	if err := fake.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fake.stop)
+
+	return fake
+}
+
+// methods exported on a path and interface
+type export struct {
+	methods map[string]interface{}
+	path    dbus.ObjectPath
+	iface   string
+}
+
+func fwdErr(code, msg string) *dbus.Error {
+	return dbus.NewError(fwdInterface+".Exception", []interface{}{code + ": " + msg})
+}
+
+// start connects to the bus, exports firewalld and takes its name
+func (fake *fakeFirewalld) start() error {
+	conn, err := dbus.Dial(fake.address)
+	if err != nil {
+		return err
+	}
+	if err := conn.Auth(nil); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := conn.Hello(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	fake.mu.Lock()
+	fake.conn = conn
+	fake.mu.Unlock()
+
+	exports := []export{
+		{fake.main(), fwdObjPath, fwdInterface},
+		{fake.zone(), fwdObjPath, fwdInterface + ".zone"},
+		{fake.ipset(), fwdObjPath, fwdInterface + ".ipset"},
+		{fake.config(), fwdConfigPath, fwdConfigInterface},
+	}
+	fake.mu.Lock()
+	for zone := range fake.permanentRules {
+		exports = append(exports, export{fake.configZone(zone), fake.zonePath(zone), fwdConfigZoneInterface})
+	}
+	for name := range fake.permanentIPSets {
+		exports = append(exports, export{fake.configIPSet(name), fake.ipsetPath(name), fwdConfigIPSetInterface})
+	}
+	fake.mu.Unlock()
+
+	for _, e := range exports {
+		if err := conn.ExportMethodTable(e.methods, e.path, e.iface); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	reply, err := conn.RequestName(fwdInterface, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		conn.Close()
+		return fmt.Errorf("fake firewalld: cannot own %s: %v", fwdInterface, err)
+	}
+
+	return nil
+}
+
+// stop drops firewalld from the bus, as if it had been stopped
+func (fake *fakeFirewalld) stop() {
+	fake.mu.Lock()
+	conn := fake.conn
+	fake.conn = nil
+	fake.mu.Unlock()
+
+	if conn != nil {
+		conn.ReleaseName(fwdInterface)
+		conn.Close()
+	}
+}
+
+// restart firewalld, the runtime is rebuilt from the permanent config
+func (fake *fakeFirewalld) restart(t *testing.T) {
+	fake.stop()
+	fake.mu.Lock()
+	fake.load()
+	fake.mu.Unlock()
+	if err := fake.start(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reload firewalld, emitting Reloaded once the runtime is rebuilt
+func (fake *fakeFirewalld) reload() *dbus.Error {
+	fake.mu.Lock()
+	fake.load()
+	fake.reloads++
+	conn := fake.conn
+	fake.mu.Unlock()
+
+	if err := conn.Emit(fwdObjPath, fwdInterface+".Reloaded"); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+
+	return nil
+}
+
+// replace the runtime with the permanent config, the caller holds the lock
+func (fake *fakeFirewalld) load() {
+	for zone, rules := range fake.permanentRules {
+		fake.rules[zone] = make(map[string]int32)
+		for rule := range rules {
+			fake.rules[zone][rule] = 0
+		}
+	}
+
+	fake.ipsets = make(map[string]map[string]bool)
+	for name, entries := range fake.permanentIPSets {
+		fake.ipsets[name] = make(map[string]bool)
+		for entry := range entries {
+			fake.ipsets[name][entry] = true
+		}
+	}
+}
+
+func (fake *fakeFirewalld) zonePath(zone string) dbus.ObjectPath {
+	return dbus.ObjectPath(fwdConfigPath + "/zone/" + zone)
+}
+
+func (fake *fakeFirewalld) ipsetPath(name string) dbus.ObjectPath {
+	return dbus.ObjectPath(fwdConfigPath + "/ipset/" + strings.Replace(name, "-", "_", -1))
+}
+
+// Rules returns the runtime rich rules in the zone and their timeouts
+func (fake *fakeFirewalld) Rules(zone string) map[string]int32 {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	rules := make(map[string]int32)
+	for rule, timeout := range fake.rules[zone] {
+		rules[rule] = timeout
+	}
+
+	return rules
+}
+
+// PermanentRules returns the rich rules in the permanent config of the zone
+func (fake *fakeFirewalld) PermanentRules(zone string) map[string]int32 {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	rules := make(map[string]int32)
+	for rule, timeout := range fake.permanentRules[zone] {
+		rules[rule] = timeout
+	}
+
+	return rules
+}
+
+// Entries returns the runtime entries of the ipset
+func (fake *fakeFirewalld) Entries(name string) []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return sortedKeys(fake.ipsets[name])
+}
+
+// Reloads returns the number of times firewalld has been reloaded
+func (fake *fakeFirewalld) Reloads() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return fake.reloads
+}
+
+// AddRule inserts a rich rule directly, e.g. one written by hand
+func (fake *fakeFirewalld) AddRule(zone, rule string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.rules[zone][normalRule(rule)] = 0
+}
+
+// the order firewalld lists the parts of a rich rule in, see Rich_Rule in
+// firewalld's rich.py
+var richRuleOrder = map[string]int{
+	"rule": 0, "source": 1, "destination": 2,
+	"service": 3, "port": 3, "protocol": 3, "icmp-block": 3, "icmp-type": 3,
+	"masquerade": 3, "forward-port": 3, "source-port": 3,
+	"log": 4, "nflog": 4, "audit": 5,
+	"accept": 6, "reject": 6, "drop": 6, "mark": 6,
+}
+
+// firewalld parses rich rules, so the quotes and the order of the parts do not
+// matter, and lists them in its own canonical form with double quotes and the
+// parts in richRuleOrder
+func normalRule(rule string) string {
+	var parts [][]string
+	for _, token := range strings.Fields(rule) {
+		if key := strings.SplitN(token, "=", 2); len(key) == 2 {
+			token = key[0] + `="` + strings.Trim(key[1], `"'`) + `"`
+		} else if token != "not" {
+			parts = append(parts, nil)
+		}
+		if len(parts) == 0 {
+			parts = append(parts, nil)
+		}
+		parts[len(parts)-1] = append(parts[len(parts)-1], token)
+	}
+
+	sort.SliceStable(parts, func(i, j int) bool {
+		return richRuleOrder[parts[i][0]] < richRuleOrder[parts[j][0]]
+	})
+
+	tokens := make([]string, 0)
+	for _, part := range parts {
+		tokens = append(tokens, part...)
+	}
+
+	return strings.Join(tokens, " ")
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// the org.fedoraproject.FirewallD1 methods
+func (fake *fakeFirewalld) main() map[string]interface{} {
+	return map[string]interface{}{
+		"getDefaultZone": func() (string, *dbus.Error) {
+			return "public", nil
+		},
+		"reload": fake.reload,
+	}
+}
+
+// the org.fedoraproject.FirewallD1.zone methods
+func (fake *fakeFirewalld) zone() map[string]interface{} {
+	return map[string]interface{}{
+		"getZones": func() ([]string, *dbus.Error) {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			zones := make([]string, 0, len(fake.rules))
+			for zone := range fake.rules {
+				zones = append(zones, zone)
+			}
+			sort.Strings(zones)
+
+			return zones, nil
+		},
+		"getZoneOfInterface": func(iface string) (string, *dbus.Error) {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			return fake.interfaces[iface], nil
+		},
+		"addRichRule": func(zone, rule string, timeout int32) (string, *dbus.Error) {
+			rule = normalRule(rule)
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			rules, ok := fake.rules[zone]
+			if !ok {
+				return "", fwdErr("INVALID_ZONE", zone)
+			}
+			if _, ok := rules[rule]; ok {
+				return "", fwdErr(alreadyEnabled, rule)
+			}
+			rules[rule] = timeout
+
+			return zone, nil
+		},
+		"removeRichRule": func(zone, rule string) (string, *dbus.Error) {
+			rule = normalRule(rule)
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			rules, ok := fake.rules[zone]
+			if !ok {
+				return "", fwdErr("INVALID_ZONE", zone)
+			}
+			if _, ok := rules[rule]; !ok {
+				return "", fwdErr(notEnabled, rule)
+			}
+			delete(rules, rule)
+
+			return zone, nil
+		},
+		"getRichRules": func(zone string) ([]string, *dbus.Error) {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			rules, ok := fake.rules[zone]
+			if !ok {
+				return nil, fwdErr("INVALID_ZONE", zone)
+			}
+
+			list := make([]string, 0, len(rules))
+			for rule := range rules {
+				// firewalld lists rules with double quotes
+				list = append(list, strings.Replace(rule, "'", `"`, -1))
+			}
+			sort.Strings(list)
+
+			return list, nil
+		},
+	}
+}
+
+// the org.fedoraproject.FirewallD1.ipset methods
+func (fake *fakeFirewalld) ipset() map[string]interface{} {
+	entries := func(name string) (map[string]bool, *dbus.Error) {
+		set, ok := fake.ipsets[name]
+		if !ok {
+			return nil, fwdErr("INVALID_IPSET", name)
+		}
+		return set, nil
+	}
+
+	return map[string]interface{}{
+		"getIPSets": func() ([]string, *dbus.Error) {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			names := make([]string, 0, len(fake.ipsets))
+			for name := range fake.ipsets {
+				names = append(names, name)
+			}
+
+			return names, nil
+		},
+		"getIPSetSettings": func(name string) (ipsetSettings, *dbus.Error) {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			settings, ok := fake.settings[name]
+			if !ok {
+				return settings, fwdErr("INVALID_IPSET", name)
+			}
+
+			return settings, nil
+		},
+		"addEntry": func(name, entry string) *dbus.Error {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			set, err := entries(name)
+			if err != nil {
+				return err
+			}
+			if set[entry] {
+				return fwdErr(alreadyEnabled, entry)
+			}
+			set[entry] = true
+
+			return nil
+		},
+		"removeEntry": func(name, entry string) *dbus.Error {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			set, err := entries(name)
+			if err != nil {
+				return err
+			}
+			if !set[entry] {
+				return fwdErr(notEnabled, entry)
+			}
+			delete(set, entry)
+
+			return nil
+		},
+		"getEntries": func(name string) ([]string, *dbus.Error) {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			set, err := entries(name)
+			if err != nil {
+				return nil, err
+			}
+
+			return sortedKeys(set), nil
+		},
+	}
+}
+
+// the org.fedoraproject.FirewallD1.config methods
+func (fake *fakeFirewalld) config() map[string]interface{} {
+	return map[string]interface{}{
+		"getIPSetNames": func() ([]string, *dbus.Error) {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			names := make([]string, 0, len(fake.permanentIPSets))
+			for name := range fake.permanentIPSets {
+				names = append(names, name)
+			}
+
+			return names, nil
+		},
+		"addIPSet": func(name string, settings ipsetSettings) (dbus.ObjectPath, *dbus.Error) {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			if _, ok := fake.permanentIPSets[name]; ok {
+				return "", fwdErr("NAME_CONFLICT", name)
+			}
+			fake.permanentIPSets[name] = make(map[string]bool)
+			fake.settings[name] = settings
+
+			path := fake.ipsetPath(name)
+			if err := fake.conn.ExportMethodTable(fake.configIPSet(name), path, fwdConfigIPSetInterface); err != nil {
+				return "", dbus.MakeFailedError(err)
+			}
+
+			return path, nil
+		},
+		"getZoneByName": func(zone string) (dbus.ObjectPath, *dbus.Error) {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			if _, ok := fake.permanentRules[zone]; !ok {
+				return "", fwdErr("INVALID_ZONE", zone)
+			}
+
+			return fake.zonePath(zone), nil
+		},
+		"getIPSetByName": func(name string) (dbus.ObjectPath, *dbus.Error) {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			if _, ok := fake.permanentIPSets[name]; !ok {
+				return "", fwdErr("INVALID_IPSET", name)
+			}
+
+			return fake.ipsetPath(name), nil
+		},
+	}
+}
+
+// the org.fedoraproject.FirewallD1.config.zone methods of a zone
+func (fake *fakeFirewalld) configZone(zone string) map[string]interface{} {
+	return map[string]interface{}{
+		"addRichRule": func(rule string) *dbus.Error {
+			rule = normalRule(rule)
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			if _, ok := fake.permanentRules[zone][rule]; ok {
+				return fwdErr(alreadyEnabled, rule)
+			}
+			fake.permanentRules[zone][rule] = 0
+
+			return nil
+		},
+		"removeRichRule": func(rule string) *dbus.Error {
+			rule = normalRule(rule)
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			if _, ok := fake.permanentRules[zone][rule]; !ok {
+				return fwdErr(notEnabled, rule)
+			}
+			delete(fake.permanentRules[zone], rule)
+
+			return nil
+		},
+		"getRichRules": func() ([]string, *dbus.Error) {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			list := make([]string, 0, len(fake.permanentRules[zone]))
+			for rule := range fake.permanentRules[zone] {
+				list = append(list, strings.Replace(rule, "'", `"`, -1))
+			}
+			sort.Strings(list)
+
+			return list, nil
+		},
+	}
+}
+
+// the org.fedoraproject.FirewallD1.config.ipset methods of an ipset
+func (fake *fakeFirewalld) configIPSet(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"addEntry": func(entry string) *dbus.Error {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			if fake.permanentIPSets[name][entry] {
+				return fwdErr(alreadyEnabled, entry)
+			}
+			fake.permanentIPSets[name][entry] = true
+
+			return nil
+		},
+		"removeEntry": func(entry string) *dbus.Error {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			if !fake.permanentIPSets[name][entry] {
+				return fwdErr(notEnabled, entry)
+			}
+			delete(fake.permanentIPSets[name], entry)
+
+			return nil
+		},
+	}
+}
+
+// eventually polls the condition until it holds or a few seconds have passed
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
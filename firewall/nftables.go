@@ -0,0 +1,492 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	nftTable    = "rbh"
+	nftChain    = "input"
+	nftNATChain = "prerouting"
+	nftSetV4    = "banned4"
+	nftSetV6    = "banned6"
+)
+
+// NftablesBackend enforces bans natively with nftables over netlink. It manages
+// a dedicated table which is the equivalent of the following ruleset:
+//
+//	table inet rbh {
+//	    set banned4 { type ipv4_addr; flags interval, timeout; }
+//	    set banned6 { type ipv6_addr; flags interval, timeout; }
+//
+//	    chain input {
+//	        type filter hook input priority -10; policy accept;
+//	        meta nfproto ipv4 ip saddr @banned4 log prefix "rbh:banned "
+//	        meta nfproto ipv4 ip saddr @banned4 drop
+//	        meta nfproto ipv6 ip6 saddr @banned6 log prefix "rbh:banned "
+//	        meta nfproto ipv6 ip6 saddr @banned6 drop
+//	    }
+//
+//	    chain prerouting {
+//	        type nat hook prerouting priority -110; policy accept;
+//	    }
+//	}
+//
+// The drop verdict is replaced by a reject if the Action rejects, and a port
+// scoped Action only matches `tcp dport 51235` and, with another pair of rules,
+// `tcp sport 51235` for replies on outbound connections to the peer. A tarpit
+// instead redirects the peer port in the prerouting chain, e.g.
+//
+//	meta nfproto ipv4 ip saddr @banned4 tcp dport 51235 redirect to :2222
+//
+// The log rules are rate limited by the Action's LogLimit, if set. A ban is a
+// single set interval covering the banned address or network with its own
+// timeout, the kernel removes the interval when the timeout is reached. The
+// interval's comment holds the reason for the ban e.g. rbh:old-version.
+//
+// Needless to say, this requires root or CAP_NET_ADMIN.
+type NftablesBackend struct {
+	mu     sync.Mutex
+	conn   *nftables.Conn
+	action Action
+	table  *nftables.Table
+	set4   *nftables.Set
+	set6   *nftables.Set
+}
+
+// NewNftablesBackend returns a Backend using nftables which takes the action
+// on banned sources, the rbh table is created if it does not already exist
+func NewNftablesBackend(action Action) (*NftablesBackend, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("nftables: %v", err)
+	}
+
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: nftTable}
+	nft := &NftablesBackend{
+		conn:   conn,
+		action: action,
+		table:  table,
+		set4: &nftables.Set{
+			Table:      table,
+			Name:       nftSetV4,
+			KeyType:    nftables.TypeIPAddr,
+			Interval:   true,
+			HasTimeout: true,
+		},
+		set6: &nftables.Set{
+			Table:      table,
+			Name:       nftSetV6,
+			KeyType:    nftables.TypeIP6Addr,
+			Interval:   true,
+			HasTimeout: true,
+		},
+	}
+
+	if err := nft.setup(); err != nil {
+		return nil, err
+	}
+
+	return nft, nil
+}
+
+// setup creates the table, sets and chain. Existing sets are left untouched so
+// bans survive an rbh restart, the chain is flushed and its rules re-added so
+// they are never duplicated.
+func (nft *NftablesBackend) setup() error {
+	nft.mu.Lock()
+	defer nft.mu.Unlock()
+
+	nft.conn.AddTable(nft.table)
+
+	for _, set := range []*nftables.Set{nft.set4, nft.set6} {
+		if err := nft.conn.AddSet(set, nil); err != nil {
+			return fmt.Errorf("nftables: %v", err)
+		}
+	}
+
+	chain := nft.conn.AddChain(&nftables.Chain{
+		Name:     nftChain,
+		Table:    nft.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityRef(*nftables.ChainPriorityFilter - 10),
+	})
+	nft.conn.FlushChain(chain)
+
+	natChain := nft.conn.AddChain(&nftables.Chain{
+		Name:     nftNATChain,
+		Table:    nft.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityRef(*nftables.ChainPriorityNATDest - 10),
+	})
+	nft.conn.FlushChain(natChain)
+
+	if nft.action.kind() == ActionTarpit {
+		chain = natChain
+	}
+
+	sources := []struct {
+		proto          byte
+		offset, length uint32
+		set            *nftables.Set
+	}{
+		{unix.NFPROTO_IPV4, 12, net.IPv4len, nft.set4},
+		{unix.NFPROTO_IPV6, 8, net.IPv6len, nft.set6},
+	}
+	for _, src := range sources {
+		for _, port := range nftPortMatches(nft.action) {
+			nft.conn.AddRule(&nftables.Rule{
+				Table: nft.table,
+				Chain: chain,
+				Exprs: nftSourceLog(src.proto, src.offset, src.length, src.set, port, nft.action),
+			})
+			nft.conn.AddRule(&nftables.Rule{
+				Table: nft.table,
+				Chain: chain,
+				Exprs: nftSourceAction(src.proto, src.offset, src.length, src.set, port, nft.action),
+			})
+		}
+	}
+
+	if err := nft.conn.Flush(); err != nil {
+		return fmt.Errorf("nftables: cannot create table '%s': %v", nftTable, err)
+	}
+	log.Println("nftables: table - inet", nftTable)
+
+	return nil
+}
+
+// The expressions matching packets from a source address found in the set, and
+// the port, one of nftPortMatches. The offset and length locate the source
+// address in the IP header.
+func nftSourceMatch(proto byte, offset, length uint32, set *nftables.Set, port []expr.Any) []expr.Any {
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          length,
+		},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	}
+
+	return append(exprs, port...)
+}
+
+// The expressions matching the peer port for the action, a rule is added for
+// each. A port scoped action matches packets to the peer port, and from it for
+// replies on outbound connections, a tarpit only packets to the peer port. An
+// action on all traffic has a single empty match.
+func nftPortMatches(action Action) [][]expr.Any {
+	switch {
+	case action.kind() == ActionTarpit:
+		return [][]expr.Any{nftTCPPort(nftDport, action.port())}
+	case action.scoped():
+		return [][]expr.Any{nftTCPPort(nftDport, action.port()), nftTCPPort(nftSport, action.port())}
+	}
+
+	return [][]expr.Any{nil}
+}
+
+// The expressions for a rule logging packets from a source address found in
+// the set, at the rate of the action's log limit. The rule has no verdict so
+// the packet goes on to the rule taking the action.
+func nftSourceLog(proto byte, offset, length uint32, set *nftables.Set, port []expr.Any, action Action) []expr.Any {
+	exprs := nftSourceMatch(proto, offset, length, set, port)
+
+	if rate, unit := action.logLimit(); rate > 0 {
+		exprs = append(exprs, &expr.Limit{
+			Type:  expr.LimitTypePkts,
+			Rate:  rate,
+			Unit:  expr.LimitTime(unit / time.Second),
+			Burst: 5,
+		})
+	}
+
+	return append(exprs, &expr.Log{
+		Key:  1 << unix.NFTA_LOG_PREFIX,
+		Data: []byte(logPrefix(ReasonBanned) + " "),
+	})
+}
+
+// The expressions for a rule taking the action on packets from a source
+// address found in the set
+func nftSourceAction(proto byte, offset, length uint32, set *nftables.Set, port []expr.Any, action Action) []expr.Any {
+	exprs := nftSourceMatch(proto, offset, length, set, port)
+
+	v6 := proto == unix.NFPROTO_IPV6
+
+	switch action.kind() {
+	case ActionReject:
+		code := icmpTypes["icmp-port-unreachable"]
+		if v6 {
+			code = icmp6Types["icmp6-port-unreachable"]
+		}
+		if with := action.rejectWith(v6); with != "" {
+			if v6 {
+				code = icmp6Types[with]
+			} else {
+				code = icmpTypes[with]
+			}
+		}
+		exprs = append(exprs, &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: code})
+	case ActionTarpit:
+		exprs = append(exprs,
+			&expr.Immediate{Register: 1, Data: nftPort(action.ToPort)},
+			&expr.Redir{RegisterProtoMin: 1},
+		)
+	default:
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictDrop})
+	}
+
+	return exprs
+}
+
+// the offsets of the source and destination ports in the TCP header
+const (
+	nftSport = 0
+	nftDport = 2
+)
+
+// the expressions matching TCP packets with the port at the offset, nftSport
+// or nftDport
+func nftTCPPort(offset uint32, port int) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       offset,
+			Len:          2,
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftPort(port)},
+	}
+}
+
+// a port in network byte order
+func nftPort(port int) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(port))
+
+	return b
+}
+
+// the set and interval elements for a ban, the interval runs from the first
+// address of the banned network up to but not including the end key. The end
+// is left open for a network at the very end of the address space.
+func (nft *NftablesBackend) elements(ban *Ban) (*nftables.Set, []nftables.SetElement, error) {
+	if ban.IP.To16() == nil {
+		return nil, nil, fmt.Errorf("nftables: invalid IP address '%s'", ban.IP)
+	}
+
+	network := ban.Net()
+	set := nft.set6
+	if len(network.IP) == net.IPv4len {
+		set = nft.set4
+	}
+
+	elements := []nftables.SetElement{{
+		Key:     network.IP,
+		Timeout: ban.Timeout(),
+		Comment: logPrefix(ban.Reason),
+	}}
+	if end := nftIntervalEnd(network); end != nil {
+		elements = append(elements, nftables.SetElement{Key: end, IntervalEnd: true})
+	}
+
+	return set, elements, nil
+}
+
+// the address following the last address in the network, or nil if there is
+// no such address
+func nftIntervalEnd(network *net.IPNet) []byte {
+	end := make([]byte, len(network.IP))
+	for i := range end {
+		end[i] = network.IP[i] | ^network.Mask[i]
+	}
+
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end
+		}
+	}
+
+	return nil
+}
+
+// the prefix length of the interval from start up to end, a nil end is the
+// end of the address space
+func nftPrefix(start, end []byte) int {
+	bits := 8 * len(start)
+	for prefix := 0; prefix <= bits; prefix++ {
+		network := &net.IPNet{IP: start, Mask: net.CIDRMask(prefix, bits)}
+		if !net.IP(start).Mask(network.Mask).Equal(net.IP(start)) {
+			continue
+		}
+		if bytes.Equal(nftIntervalEnd(network), end) {
+			return prefix
+		}
+	}
+
+	return bits
+}
+
+// Ban adds the source to the banned set with the time remaining on the ban
+func (nft *NftablesBackend) Ban(ban *Ban) error {
+	set, elements, err := nft.elements(ban)
+	if err != nil {
+		return err
+	}
+
+	nft.mu.Lock()
+	defer nft.mu.Unlock()
+
+	log.Println(fmt.Sprintf("nftables: adding %s to set %s", ban.CIDR(), set.Name))
+
+	if err := nft.conn.SetAddElements(set, elements); err != nil {
+		return fmt.Errorf("nftables: %v", err)
+	}
+
+	// the interval overlaps a network which is already banned
+	if err := nft.conn.Flush(); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return err
+	}
+
+	return nil
+}
+
+// Unban removes the source from the banned set
+func (nft *NftablesBackend) Unban(ban *Ban) error {
+	set, elements, err := nft.elements(ban)
+	if err != nil {
+		return err
+	}
+
+	nft.mu.Lock()
+	defer nft.mu.Unlock()
+
+	log.Println(fmt.Sprintf("nftables: removing %s from set %s", ban.CIDR(), set.Name))
+
+	if err := nft.conn.SetDeleteElements(set, elements); err != nil {
+		return fmt.Errorf("nftables: %v", err)
+	}
+
+	if err := nft.conn.Flush(); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return err
+	}
+
+	return nil
+}
+
+// List returns the bans in the banned sets along with the time the kernel has
+// left on each element
+func (nft *NftablesBackend) List() ([]*Ban, error) {
+	nft.mu.Lock()
+	defer nft.mu.Unlock()
+
+	bans := make([]*Ban, 0)
+	for _, set := range []*nftables.Set{nft.set4, nft.set6} {
+		elements, err := nft.conn.GetSetElements(set)
+		if err != nil {
+			return nil, fmt.Errorf("nftables: %v", err)
+		}
+
+		// pair each interval start with the end following it
+		sort.Slice(elements, func(i, j int) bool {
+			if c := bytes.Compare(elements[i].Key, elements[j].Key); c != 0 {
+				return c < 0
+			}
+			return elements[i].IntervalEnd && !elements[j].IntervalEnd
+		})
+
+		for i, element := range elements {
+			if element.IntervalEnd {
+				continue
+			}
+
+			var end []byte
+			if i+1 < len(elements) && elements[i+1].IntervalEnd {
+				end = elements[i+1].Key
+			}
+
+			ban := &Ban{IP: net.IP(element.Key), Prefix: nftPrefix(element.Key, end)}
+			if strings.HasPrefix(element.Comment, LogPrefix) {
+				ban.Reason = strings.TrimPrefix(element.Comment, LogPrefix)
+			}
+			if element.Expires > 0 {
+				ban.Expires = time.Now().Add(element.Expires)
+			}
+			bans = append(bans, ban)
+		}
+	}
+
+	return bans, nil
+}
+
+// Reconcile re-creates the table if it has been removed, e.g. by a `nft flush
+// ruleset`, and re-adds the bans with the time remaining on each
+func (nft *NftablesBackend) Reconcile(bans []*Ban) error {
+	if err := nft.setup(); err != nil {
+		return err
+	}
+
+	for _, ban := range bans {
+		if ban.Timeout() <= 0 {
+			continue
+		}
+
+		if err := nft.Ban(ban); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+// Health returns an error if the rbh table cannot be found
+func (nft *NftablesBackend) Health() error {
+	nft.mu.Lock()
+	defer nft.mu.Unlock()
+
+	if _, err := nft.conn.ListTableOfFamily(nftTable, nftables.TableFamilyINet); err != nil {
+		return fmt.Errorf("nftables: table '%s' unavailable: %v", nftTable, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package firewall
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+var intervalTests = []struct {
+	cidr string
+	end  string
+}{
+	{"192.0.2.10/32", "192.0.2.11"},
+	{"192.0.2.0/24", "192.0.3.0"},
+	{"192.0.2.255/32", "192.0.3.0"},
+	{"2001:db8::10/128", "2001:db8::11"},
+	{"2001:db8:1::/64", "2001:db8:1:1::"},
+	{"0.0.0.0/0", ""},
+	{"::/0", ""},
+	{"255.255.255.255/32", ""},
+	{"255.255.255.0/24", ""},
+	{"ffff:ffff:ffff:ffff::/64", ""},
+}
+
+func TestNftIntervalEnd(t *testing.T) {
+	for _, tt := range intervalTests {
+		network := mustParseCIDR(t, tt.cidr)
+
+		end := nftIntervalEnd(network)
+		if tt.end == "" {
+			if end != nil {
+				t.Errorf("%s: expected no interval end, got %s", tt.cidr, net.IP(end))
+			}
+			continue
+		}
+
+		want := net.ParseIP(tt.end)
+		if len(network.IP) == net.IPv4len {
+			want = want.To4()
+		}
+		if !bytes.Equal(end, want) {
+			t.Errorf("%s: expected the interval to end at %s, got %s", tt.cidr, tt.end, net.IP(end))
+		}
+	}
+}
+
+func TestNftPrefix(t *testing.T) {
+	for _, tt := range intervalTests {
+		network := mustParseCIDR(t, tt.cidr)
+
+		want, _ := network.Mask.Size()
+		if prefix := nftPrefix(network.IP, nftIntervalEnd(network)); prefix != want {
+			t.Errorf("%s: expected a prefix of %d, got %d", tt.cidr, want, prefix)
+		}
+	}
+}
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return network
+}
+
+// the offsets and ports of the TCP port matches in the expressions
+func nftPortsMatched(exprs []expr.Any) (offsets []uint32, ports [][]byte) {
+	for i, e := range exprs {
+		payload, ok := e.(*expr.Payload)
+		if !ok || payload.Base != expr.PayloadBaseTransportHeader || i+1 >= len(exprs) {
+			continue
+		}
+		if cmp, ok := exprs[i+1].(*expr.Cmp); ok {
+			offsets = append(offsets, payload.Offset)
+			ports = append(ports, cmp.Data)
+		}
+	}
+
+	return offsets, ports
+}
+
+func TestNftPortMatches(t *testing.T) {
+	var tests = []struct {
+		action  Action
+		offsets []uint32
+	}{
+		{Action{}, nil},
+		{Action{Type: ActionReject}, nil},
+		{Action{PortOnly: true}, []uint32{nftDport, nftSport}},
+		{Action{Type: ActionReject, Port: 51000, PortOnly: true}, []uint32{nftDport, nftSport}},
+		{Action{Type: ActionTarpit, ToPort: 2222}, []uint32{nftDport}},
+		{Action{Type: ActionTarpit, ToPort: 2222, PortOnly: true}, []uint32{nftDport}},
+	}
+
+	for _, tt := range tests {
+		matches := nftPortMatches(tt.action)
+
+		var offsets []uint32
+		for _, match := range matches {
+			matched, ports := nftPortsMatched(match)
+			for _, port := range ports {
+				if !bytes.Equal(port, nftPort(tt.action.port())) {
+					t.Errorf("%+v: expected port %d, got %v", tt.action, tt.action.port(), port)
+				}
+			}
+			offsets = append(offsets, matched...)
+		}
+
+		if len(tt.offsets) == 0 {
+			if len(matches) != 1 || len(offsets) != 0 {
+				t.Errorf("%+v: expected a single match of any port, got %v", tt.action, matches)
+			}
+			continue
+		}
+		if len(matches) != len(tt.offsets) || len(offsets) != len(tt.offsets) {
+			t.Fatalf("%+v: expected ports at offsets %v, got %v", tt.action, tt.offsets, offsets)
+		}
+		for i := range offsets {
+			if offsets[i] != tt.offsets[i] {
+				t.Errorf("%+v: expected ports at offsets %v, got %v", tt.action, tt.offsets, offsets)
+			}
+		}
+	}
+}
+
+func TestNftSourceMatch(t *testing.T) {
+	set := &nftables.Set{Name: nftSetV4}
+
+	var tests = []struct {
+		proto          byte
+		offset, length uint32
+	}{
+		{unix.NFPROTO_IPV4, 12, net.IPv4len},
+		{unix.NFPROTO_IPV6, 8, net.IPv6len},
+	}
+
+	for _, tt := range tests {
+		exprs := nftSourceMatch(tt.proto, tt.offset, tt.length, set, nftTCPPort(nftDport, DefaultPeerPort))
+
+		if cmp, ok := exprs[1].(*expr.Cmp); !ok || !bytes.Equal(cmp.Data, []byte{tt.proto}) {
+			t.Errorf("protocol %d: expected the family to be matched first, got %+v", tt.proto, exprs[1])
+		}
+		if payload, ok := exprs[2].(*expr.Payload); !ok || payload.Offset != tt.offset || payload.Len != tt.length {
+			t.Errorf("protocol %d: unexpected source address payload %+v", tt.proto, exprs[2])
+		}
+		if lookup, ok := exprs[3].(*expr.Lookup); !ok || lookup.SetName != set.Name {
+			t.Errorf("protocol %d: expected a lookup in %s, got %+v", tt.proto, set.Name, exprs[3])
+		}
+		if offsets, _ := nftPortsMatched(exprs); len(offsets) != 1 || offsets[0] != nftDport {
+			t.Errorf("protocol %d: expected the port match to follow, got %v", tt.proto, offsets)
+		}
+	}
+}
+
+func TestNftSourceAction(t *testing.T) {
+	var tests = []struct {
+		action Action
+		proto  byte
+		code   uint8
+	}{
+		{Action{Type: ActionReject}, unix.NFPROTO_IPV4, icmpTypes["icmp-port-unreachable"]},
+		{Action{Type: ActionReject}, unix.NFPROTO_IPV6, icmp6Types["icmp6-port-unreachable"]},
+		{Action{Type: ActionReject, RejectWith: "icmp-host-prohibited"}, unix.NFPROTO_IPV4, icmpTypes["icmp-host-prohibited"]},
+		{Action{Type: ActionReject, RejectWith: "icmp-host-prohibited"}, unix.NFPROTO_IPV6, icmp6Types["icmp6-port-unreachable"]},
+		{Action{Type: ActionReject, RejectWith6: "icmp6-adm-prohibited"}, unix.NFPROTO_IPV6, icmp6Types["icmp6-adm-prohibited"]},
+	}
+
+	set := &nftables.Set{Name: nftSetV4}
+	for _, tt := range tests {
+		exprs := nftSourceAction(tt.proto, 12, net.IPv4len, set, nil, tt.action)
+		if reject, ok := exprs[len(exprs)-1].(*expr.Reject); !ok || reject.Code != tt.code {
+			t.Errorf("%+v protocol %d: expected a reject with code %d, got %+v", tt.action, tt.proto, tt.code, exprs[len(exprs)-1])
+		}
+	}
+
+	exprs := nftSourceAction(unix.NFPROTO_IPV4, 12, net.IPv4len, set, nil, Action{})
+	if verdict, ok := exprs[len(exprs)-1].(*expr.Verdict); !ok || verdict.Kind != expr.VerdictDrop {
+		t.Errorf("expected a drop verdict, got %+v", exprs[len(exprs)-1])
+	}
+
+	exprs = nftSourceAction(unix.NFPROTO_IPV6, 8, net.IPv6len, set, nil, Action{Type: ActionTarpit, ToPort: 2222})
+	if _, ok := exprs[len(exprs)-1].(*expr.Redir); !ok {
+		t.Errorf("expected a redirect, got %+v", exprs[len(exprs)-1])
+	}
+	if immediate, ok := exprs[len(exprs)-2].(*expr.Immediate); !ok || !bytes.Equal(immediate.Data, nftPort(2222)) {
+		t.Errorf("expected a redirect to port 2222, got %+v", exprs[len(exprs)-2])
+	}
+}
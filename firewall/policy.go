@@ -0,0 +1,274 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/gnanderson/xrpl"
+	"github.com/google/cel-go/cel"
+)
+
+// What a Policy does with a peer matching a rule
+const (
+	// RuleBan bans the peer
+	RuleBan = "ban"
+	// RuleObserve only logs the peer, so a rule can be trialled
+	RuleObserve = "observe"
+	// RuleAllow leaves the peer alone, no later rule is evaluated
+	RuleAllow = "allow"
+)
+
+// DefaultUptime is how long the default policy waits before it judges a
+// peer's sanity, the same as the xrpl default stability checker
+const DefaultUptime = 30 * time.Minute
+
+// Rule is a named set of thresholds, a peer matches the rule when it crosses
+// every threshold which is set and the expression, if any, is true. A rule
+// must set at least one threshold or an expression.
+type Rule struct {
+	Name string
+	// Action is one of RuleBan, RuleObserve or RuleAllow, RuleBan if unset
+	Action string
+	// BanLength is the length of the ban, the firewall's ban length if unset
+	BanLength time.Duration `mapstructure:"ban-length"`
+	// Reason labels the ban in the log prefix of its rule, the Name if unset
+	Reason string
+
+	// LatencyOver matches peers with a latency over this many milliseconds
+	LatencyOver int `mapstructure:"latency-over"`
+	// LoadOver matches peers reporting a load over this
+	LoadOver int `mapstructure:"load-over"`
+	// UptimeOver matches peers connected for longer than this, so a peer is
+	// given time to settle before it is judged
+	UptimeOver time.Duration `mapstructure:"uptime-over"`
+	// VersionBelow matches peers running a version of rippled older than
+	// this, or one which is unrecognised
+	VersionBelow string `mapstructure:"version-below"`
+	// Sanity matches peers reporting any of these, 'unknown', 'insane' or
+	// 'good'
+	Sanity []string
+	// Expr is a CEL expression over the fields of the peer and its history,
+	// see exprVariables, e.g.
+	// "peer.latency > 800 && peer.uptime > 600 && !peer.cluster"
+	Expr string
+
+	version *semver.Version
+	program cel.Program
+	history *history
+}
+
+// Policy decides what is done with a peer from an ordered list of rules. It
+// keeps a history of the peers it evaluates for rule expressions.
+type Policy struct {
+	Rules []*Rule
+
+	history *history
+}
+
+// NewPolicy validates the rules, compiling and type checking their
+// expressions, and returns a policy evaluating them in order
+func NewPolicy(rules ...Rule) (*Policy, error) {
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("firewall policy: no rules")
+	}
+
+	policy := &Policy{history: newHistory()}
+	names := make(map[string]bool)
+
+	for i := range rules {
+		rule := rules[i]
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+		rule.history = policy.history
+		if names[rule.Name] {
+			return nil, fmt.Errorf("firewall policy: duplicate rule '%s'", rule.Name)
+		}
+		names[rule.Name] = true
+
+		policy.Rules = append(policy.Rules, &rule)
+	}
+
+	return policy, nil
+}
+
+// DefaultPolicy bans peers running a version older than xrpl.MinVersion, and
+// peers reporting unknown or insane sanity once connected for DefaultUptime,
+// just as the xrpl default stability checker does. Set xrpl.MinVersion first.
+func DefaultPolicy() *Policy {
+	policy, _ := NewPolicy(
+		Rule{Name: "old-version", VersionBelow: xrpl.MinVersion.String()},
+		Rule{Name: "sanity-unknown", Sanity: []string{xrpl.Unstable}, UptimeOver: DefaultUptime},
+		Rule{Name: "sanity-insane", Sanity: []string{xrpl.Insane}, UptimeOver: DefaultUptime},
+	)
+
+	return policy
+}
+
+// Evaluate returns the first rule the peer matches, or nil if it matches none.
+// Each call is a poll of the peer in its history, so evaluate each peer once
+// per poll.
+func (p *Policy) Evaluate(peer *xrpl.Peer) *Rule {
+	p.history.observe(peer)
+
+	for _, rule := range p.Rules {
+		if rule.Match(peer) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// Check reports whether the peer is left alone by the policy, so a Policy can
+// be used as a StabilityChecker
+func (p *Policy) Check(peer *xrpl.Peer) bool {
+	rule := p.Evaluate(peer)
+	return rule == nil || rule.Action != RuleBan
+}
+
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("firewall policy: rule without a name")
+	}
+
+	switch r.Action {
+	case "":
+		r.Action = RuleBan
+	case RuleBan, RuleObserve, RuleAllow:
+	default:
+		return fmt.Errorf("firewall policy: rule '%s': unknown action '%s'", r.Name, r.Action)
+	}
+
+	if r.BanLength < 0 {
+		return fmt.Errorf("firewall policy: rule '%s': invalid ban length '%s'", r.Name, r.BanLength)
+	}
+
+	if r.Reason == "" {
+		r.Reason = r.Name
+	}
+	r.Reason = cleanReason(r.Reason)
+
+	if r.LatencyOver < 0 || r.LoadOver < 0 || r.UptimeOver < 0 {
+		return fmt.Errorf("firewall policy: rule '%s': thresholds must not be negative", r.Name)
+	}
+
+	if r.VersionBelow != "" {
+		version, err := semver.NewVersion(strings.TrimPrefix(r.VersionBelow, "rippled-"))
+		if err != nil {
+			return fmt.Errorf("firewall policy: rule '%s': invalid version '%s'", r.Name, r.VersionBelow)
+		}
+		r.version = version
+	}
+
+	for _, sanity := range r.Sanity {
+		switch sanity {
+		case xrpl.Unstable, xrpl.Insane, xrpl.Good:
+		default:
+			return fmt.Errorf("firewall policy: rule '%s': unknown sanity '%s'", r.Name, sanity)
+		}
+	}
+
+	if r.Expr != "" {
+		program, err := compileExpr(r.Expr)
+		if err != nil {
+			return fmt.Errorf("firewall policy: rule '%s': expression: %v", r.Name, err)
+		}
+		r.program = program
+	}
+
+	if r.thresholds() == 0 {
+		return fmt.Errorf("firewall policy: rule '%s' has no thresholds and would match every peer", r.Name)
+	}
+
+	return nil
+}
+
+// Match reports whether the peer crosses every threshold set in the rule and
+// the expression is true for it
+func (r *Rule) Match(peer *xrpl.Peer) bool {
+	return len(r.crossed(peer)) == r.thresholds()
+}
+
+// Describe explains why the peer matches the rule e.g.
+// "old-version: version 'rippled-1.0.0' below 1.2.4"
+func (r *Rule) Describe(peer *xrpl.Peer) string {
+	return r.Name + ": " + strings.Join(r.crossed(peer), ", ")
+}
+
+// the number of thresholds set
+func (r *Rule) thresholds() int {
+	n := 0
+	for _, set := range []bool{r.LatencyOver > 0, r.LoadOver > 0, r.UptimeOver > 0, r.version != nil, len(r.Sanity) > 0, r.program != nil} {
+		if set {
+			n++
+		}
+	}
+
+	return n
+}
+
+// the thresholds set in the rule which the peer crosses, described
+func (r *Rule) crossed(peer *xrpl.Peer) []string {
+	var crossed []string
+
+	if r.LatencyOver > 0 && peer.Latency > r.LatencyOver {
+		crossed = append(crossed, fmt.Sprintf("latency %dms over %dms", peer.Latency, r.LatencyOver))
+	}
+	if r.LoadOver > 0 && peer.Load > r.LoadOver {
+		crossed = append(crossed, fmt.Sprintf("load %d over %d", peer.Load, r.LoadOver))
+	}
+	if uptime := time.Duration(peer.Uptime) * time.Second; r.UptimeOver > 0 && uptime > r.UptimeOver {
+		crossed = append(crossed, fmt.Sprintf("uptime %s over %s", uptime, r.UptimeOver))
+	}
+	if r.version != nil {
+		if version, err := peer.SemVer(); err != nil || version.LessThan(*r.version) {
+			crossed = append(crossed, fmt.Sprintf("version '%s' below %s", peer.Version, r.version))
+		}
+	}
+	if sanity := peerSanity(peer); len(r.Sanity) > 0 && contains(r.Sanity, sanity) {
+		crossed = append(crossed, "sanity "+sanity)
+	}
+	if r.program != nil && r.evalExpr(peer) {
+		crossed = append(crossed, fmt.Sprintf("expr '%s'", r.Expr))
+	}
+
+	return crossed
+}
+
+// the sanity reported by the peer, good if it reported none
+func peerSanity(peer *xrpl.Peer) string {
+	if peer.Sanity == "" {
+		return xrpl.Good
+	}
+
+	return peer.Sanity
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,210 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gnanderson/xrpl"
+	"github.com/google/cel-go/cel"
+)
+
+// the most an expression may cost to evaluate, far more than a comparison of
+// every field needs
+const exprCostLimit = 10000
+
+// peers not seen for this long are forgotten by the policy history
+const historyExpiry = time.Hour
+
+// exprVariables are the variables a rule expression can use, named as the
+// fields are in the output of the rippled peers command. The history of a
+// peer is what the policy has seen of it since rbh started, a poll is each
+// time the policy evaluates the peer.
+var exprVariables = map[string]*cel.Type{
+	"peer.address":          cel.StringType,
+	"peer.ip":               cel.StringType,
+	"peer.public_key":       cel.StringType,
+	"peer.version":          cel.StringType,
+	"peer.sanity":           cel.StringType,
+	"peer.ledger":           cel.StringType,
+	"peer.complete_ledgers": cel.StringType,
+	"peer.latency":          cel.IntType,
+	"peer.load":             cel.IntType,
+	"peer.uptime":           cel.IntType,
+	"peer.inbound":          cel.BoolType,
+	"peer.cluster":          cel.BoolType,
+	// the number of polls the peer has been seen in, this one included
+	"history.polls": cel.IntType,
+	// seconds since the peer was first seen
+	"history.seen": cel.IntType,
+	// the number of polls the peer reported unknown or insane sanity in
+	"history.unstable": cel.IntType,
+	// the highest and the mean latency over every poll
+	"history.max_latency": cel.IntType,
+	"history.avg_latency": cel.IntType,
+}
+
+var (
+	exprEnvOnce sync.Once
+	exprEnv     *cel.Env
+	exprEnvErr  error
+)
+
+// compileExpr parses and type checks a rule expression, which must be a bool
+func compileExpr(expr string) (cel.Program, error) {
+	exprEnvOnce.Do(func() {
+		var opts []cel.EnvOption
+		for name, t := range exprVariables {
+			opts = append(opts, cel.Variable(name, t))
+		}
+		exprEnv, exprEnvErr = cel.NewEnv(opts...)
+	})
+	if exprEnvErr != nil {
+		return nil, exprEnvErr
+	}
+
+	ast, issues := exprEnv.Compile(expr)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("expected a bool, got %s", ast.OutputType())
+	}
+
+	return exprEnv.Program(ast, cel.EvalOptions(cel.OptOptimize), cel.CostLimit(exprCostLimit))
+}
+
+// evalExpr reports whether the rule's expression is true for the peer, an
+// expression which fails to evaluate, e.g. dividing by zero, is logged and
+// treated as false
+func (r *Rule) evalExpr(peer *xrpl.Peer) bool {
+	out, _, err := r.program.Eval(exprActivation(peer, r.history.get(peer)))
+	if err != nil {
+		log.Printf("firewall policy: rule '%s': %v", r.Name, err)
+		return false
+	}
+
+	matched, ok := out.Value().(bool)
+	return ok && matched
+}
+
+func exprActivation(peer *xrpl.Peer, seen peerHistory) map[string]interface{} {
+	var ip string
+	if IP := peerIP(peer); IP != nil {
+		ip = IP.String()
+	}
+
+	var avgLatency int
+	if seen.polls > 0 {
+		avgLatency = seen.latency / seen.polls
+	}
+
+	return map[string]interface{}{
+		"peer.address":          peer.Address,
+		"peer.ip":               ip,
+		"peer.public_key":       peer.PublicKey,
+		"peer.version":          peer.Version,
+		"peer.sanity":           peerSanity(peer),
+		"peer.ledger":           peer.Ledger,
+		"peer.complete_ledgers": peer.CompleteLedgers,
+		"peer.latency":          int64(peer.Latency),
+		"peer.load":             int64(peer.Load),
+		"peer.uptime":           int64(peer.Uptime),
+		"peer.inbound":          peer.Inbound,
+		"peer.cluster":          peer.Cluster,
+		"history.polls":         int64(seen.polls),
+		"history.seen":          int64(seen.lastSeen.Sub(seen.firstSeen) / time.Second),
+		"history.unstable":      int64(seen.unstable),
+		"history.max_latency":   int64(seen.maxLatency),
+		"history.avg_latency":   int64(avgLatency),
+	}
+}
+
+// peerHistory is what the policy has seen of a peer
+type peerHistory struct {
+	firstSeen, lastSeen time.Time
+	polls, unstable     int
+	// latency is the total over every poll
+	latency, maxLatency int
+}
+
+// history of the peers a policy has evaluated, by public key
+type history struct {
+	sync.Mutex
+	peers  map[string]*peerHistory
+	pruned time.Time
+}
+
+func newHistory() *history {
+	return &history{peers: make(map[string]*peerHistory), pruned: time.Now()}
+}
+
+// observe records a poll of the peer, forgetting peers no longer seen
+func (h *history) observe(peer *xrpl.Peer) {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	now := time.Now()
+	if now.Sub(h.pruned) > time.Minute {
+		for key, seen := range h.peers {
+			if now.Sub(seen.lastSeen) > historyExpiry {
+				delete(h.peers, key)
+			}
+		}
+		h.pruned = now
+	}
+
+	seen, ok := h.peers[peer.PublicKey]
+	if !ok {
+		seen = &peerHistory{firstSeen: now}
+		h.peers[peer.PublicKey] = seen
+	}
+
+	seen.lastSeen = now
+	seen.polls++
+	if peer.Sanity == xrpl.Unstable || peer.Sanity == xrpl.Insane {
+		seen.unstable++
+	}
+	seen.latency += peer.Latency
+	if peer.Latency > seen.maxLatency {
+		seen.maxLatency = peer.Latency
+	}
+}
+
+// get returns what has been seen of the peer, nothing if it has never been
+// observed
+func (h *history) get(peer *xrpl.Peer) peerHistory {
+	if h == nil {
+		return peerHistory{}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if seen, ok := h.peers[peer.PublicKey]; ok {
+		return *seen
+	}
+
+	return peerHistory{}
+}
@@ -0,0 +1,239 @@
+package firewall
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnanderson/xrpl"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+const hour = 3600
+
+var policyPeers = []struct {
+	peer *xrpl.Peer
+	rule string
+}{
+	{&xrpl.Peer{Version: "rippled-1.3.1", Uptime: hour}, ""},
+	{&xrpl.Peer{Version: "rippled-1.0.0", Uptime: 60}, "old-version"},
+	{&xrpl.Peer{Version: "unknown", Uptime: 60}, "old-version"},
+	{&xrpl.Peer{Version: "rippled-1.3.1", Uptime: 60, Sanity: xrpl.Insane}, ""},
+	{&xrpl.Peer{Version: "rippled-1.3.1", Uptime: hour, Sanity: xrpl.Insane}, "sanity-insane"},
+	{&xrpl.Peer{Version: "rippled-1.3.1", Uptime: hour, Sanity: xrpl.Unstable}, "sanity-unknown"},
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	policy := DefaultPolicy()
+
+	for _, tt := range policyPeers {
+		var name string
+		if rule := policy.Evaluate(tt.peer); rule != nil {
+			name = rule.Name
+		}
+		if name != tt.rule {
+			t.Errorf("%+v: expected rule '%s' got '%s'", tt.peer, tt.rule, name)
+		}
+
+		// the default policy agrees with the xrpl default stability checker
+		peer := *tt.peer
+		if policy.Check(&peer) != peer.StableWith(xrpl.DefaultStabilityChecker) {
+			t.Errorf("%+v: the default policy and stability checker disagree", tt.peer)
+		}
+	}
+}
+
+func TestPolicyRules(t *testing.T) {
+	policy, err := NewPolicy(
+		Rule{Name: "slow", LatencyOver: 800, UptimeOver: 10 * time.Minute, BanLength: time.Hour, Reason: "Too Slow"},
+		Rule{Name: "busy", Action: RuleObserve, LoadOver: 2000},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		peer   *xrpl.Peer
+		rule   string
+		stable bool
+	}{
+		{&xrpl.Peer{Latency: 900, Uptime: 60}, "", true},
+		{&xrpl.Peer{Latency: 900, Uptime: hour, Load: 3000}, "slow", false},
+		{&xrpl.Peer{Latency: 500, Uptime: hour, Load: 3000}, "busy", true},
+	}
+
+	for _, tt := range tests {
+		var name string
+		if rule := policy.Evaluate(tt.peer); rule != nil {
+			name = rule.Name
+		}
+		if name != tt.rule {
+			t.Errorf("%+v: expected rule '%s' got '%s'", tt.peer, tt.rule, name)
+		}
+		if policy.Check(tt.peer) != tt.stable {
+			t.Errorf("%+v: expected stable %v", tt.peer, tt.stable)
+		}
+	}
+
+	slow := policy.Rules[0]
+	if slow.Action != RuleBan || slow.Reason != "too-slow" {
+		t.Errorf("unexpected defaults for rule %+v", slow)
+	}
+
+	describe := slow.Describe(tests[1].peer)
+	if describe != "slow: latency 900ms over 800ms, uptime 1h0m0s over 10m0s" {
+		t.Errorf("unexpected description '%s'", describe)
+	}
+}
+
+func TestPolicyAllowStopsEvaluation(t *testing.T) {
+	policy, err := NewPolicy(
+		Rule{Name: "good", Action: RuleAllow, Sanity: []string{xrpl.Good}},
+		Rule{Name: "slow", LatencyOver: 800},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := policy.Evaluate(&xrpl.Peer{Latency: 900})
+	if rule == nil || rule.Name != "good" || !policy.Check(&xrpl.Peer{Latency: 900}) {
+		t.Errorf("expected the sane peer to be allowed, got %+v", rule)
+	}
+	if rule := policy.Evaluate(&xrpl.Peer{Latency: 900, Sanity: xrpl.Insane}); rule == nil || rule.Name != "slow" {
+		t.Errorf("expected the insane peer to be banned, got %+v", rule)
+	}
+}
+
+func TestNewPolicyErrors(t *testing.T) {
+	var tests = []struct {
+		rules []Rule
+		err   string
+	}{
+		{nil, "no rules"},
+		{[]Rule{{LatencyOver: 1}}, "without a name"},
+		{[]Rule{{Name: "a", LatencyOver: 1}, {Name: "a", LoadOver: 1}}, "duplicate"},
+		{[]Rule{{Name: "a", LatencyOver: 1, Action: "drop"}}, "unknown action"},
+		{[]Rule{{Name: "a", LatencyOver: 1, BanLength: -time.Minute}}, "ban length"},
+		{[]Rule{{Name: "a", LatencyOver: -1}}, "negative"},
+		{[]Rule{{Name: "a", VersionBelow: "one"}}, "invalid version"},
+		{[]Rule{{Name: "a", Sanity: []string{"old"}}}, "unknown sanity"},
+		{[]Rule{{Name: "a"}}, "no thresholds"},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewPolicy(tt.rules...); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%+v: expected error '%s' got %v", tt.rules, tt.err, err)
+		}
+	}
+}
+
+func TestBanPeerForLength(t *testing.T) {
+	fw, mb := newTestFirewall(10)
+
+	fw.BanPeerForLength(&xrpl.Peer{Address: banTests[0].addr, PublicKey: banTests[0].ip}, "slow", time.Hour)
+
+	rules := mb.Rules()
+	if len(rules) != 1 || rules[0].Ban.Reason != "slow" {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+	if rules[0].Timeout < 59*time.Minute {
+		t.Errorf("expected the rule's ban length, got %s", rules[0].Timeout)
+	}
+	if until := time.Until(fw.blacklist.entries[banTests[0].ip].expires); until < 59*time.Minute {
+		t.Errorf("expected the blacklist entry to expire in an hour, got %s", until)
+	}
+}
+
+func TestPolicyExpr(t *testing.T) {
+	policy, err := NewPolicy(
+		Rule{Name: "slow", Expr: "peer.latency > 800 && peer.uptime > 600 && !peer.cluster"},
+		Rule{Name: "testnet", Expr: `peer.ip.startsWith("192.0.2.")`, Sanity: []string{xrpl.Insane}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		peer *xrpl.Peer
+		rule string
+	}{
+		{&xrpl.Peer{Latency: 900, Uptime: hour}, "slow"},
+		{&xrpl.Peer{Latency: 900, Uptime: hour, Cluster: true}, ""},
+		{&xrpl.Peer{Latency: 900, Uptime: 60}, ""},
+		{&xrpl.Peer{Address: "192.0.2.10:51235", Sanity: xrpl.Insane}, "testnet"},
+		{&xrpl.Peer{Address: "192.0.2.10:51235"}, ""},
+		{&xrpl.Peer{Address: "198.51.100.10:51235", Sanity: xrpl.Insane}, ""},
+	}
+
+	for _, tt := range tests {
+		var name string
+		if rule := policy.Evaluate(tt.peer); rule != nil {
+			name = rule.Name
+		}
+		if name != tt.rule {
+			t.Errorf("%+v: expected rule '%s' got '%s'", tt.peer, tt.rule, name)
+		}
+	}
+
+	describe := policy.Rules[0].Describe(tests[0].peer)
+	if describe != "slow: expr 'peer.latency > 800 && peer.uptime > 600 && !peer.cluster'" {
+		t.Errorf("unexpected description '%s'", describe)
+	}
+}
+
+func TestPolicyExprHistory(t *testing.T) {
+	policy, err := NewPolicy(Rule{Name: "flapping", Expr: "history.polls >= 3 && history.unstable >= 2 && history.max_latency > history.avg_latency"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	polls := []*xrpl.Peer{
+		{PublicKey: "a", Latency: 100, Sanity: xrpl.Insane},
+		{PublicKey: "a", Latency: 900},
+		{PublicKey: "a", Latency: 100, Sanity: xrpl.Unstable},
+	}
+	for i, peer := range polls {
+		rule := policy.Evaluate(peer)
+		if matched := rule != nil; matched != (i == 2) {
+			t.Errorf("poll %d: unexpected match %v", i+1, matched)
+		}
+	}
+
+	// another peer has a history of its own
+	if rule := policy.Evaluate(&xrpl.Peer{PublicKey: "b", Sanity: xrpl.Insane}); rule != nil {
+		t.Errorf("expected a new peer not to match, got %+v", rule)
+	}
+}
+
+func TestPolicyExprErrors(t *testing.T) {
+	var tests = []struct {
+		expr, err string
+	}{
+		{"peer.latncy > 800", "undeclared reference"},
+		{"peer.version > 3", "no matching overload"},
+		{"peer.latency", "expected a bool"},
+		{"peer.latency >", "Syntax error"},
+	}
+
+	for _, tt := range tests {
+		_, err := NewPolicy(Rule{Name: "a", Expr: tt.expr})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("'%s': expected error '%s' got %v", tt.expr, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gnanderson/xrpl"
+)
+
+// ReportEntry is a peer which would have been banned
+type ReportEntry struct {
+	IP        net.IP
+	PublicKey string
+	Version   string
+	Reason    string
+	// Duration is the length of each ban
+	Duration time.Duration
+	// Bans is the number of times the peer would have been banned, a peer is
+	// banned again if it is still unstable once the previous ban has expired
+	Bans      int
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Expires is when the most recent ban would have been lifted
+	Expires time.Time
+}
+
+// Report records the peers a Firewall would have banned without enforcing
+// anything, so ban criteria can be trialled against real traffic. Whitelisted
+// peers are ignored just as they are by BanPeer.
+type Report struct {
+	mu        sync.Mutex
+	duration  time.Duration
+	whitelist *whitelist
+	entries   map[string]*ReportEntry
+	since     time.Time
+}
+
+// NewReport returns an empty report for bans of banLength minutes
+func NewReport(banLength int, whiteList ...string) *Report {
+	r := &Report{
+		duration:  time.Duration(banLength) * time.Minute,
+		whitelist: &whitelist{entries: make(map[string]*xrpl.Peer)},
+		entries:   make(map[string]*ReportEntry),
+		since:     time.Now(),
+	}
+
+	for _, entry := range whiteList {
+		r.whitelist.add(entry)
+	}
+
+	return r
+}
+
+// Record notes that the peer would have been banned for the reason given. A
+// peer seen again while its ban would still be in place is only marked as seen.
+func (r *Report) Record(peer *xrpl.Peer, reason string) {
+	r.RecordForLength(peer, reason, 0)
+}
+
+// RecordForLength records the peer as Record does, for a ban of the length
+// given rather than the report's ban length if it is not zero
+func (r *Report) RecordForLength(peer *xrpl.Peer, reason string, length time.Duration) {
+	if r.whitelist.contains(peer) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := r.entries[peer.PublicKey]
+	if !ok {
+		entry = &ReportEntry{PublicKey: peer.PublicKey, FirstSeen: now}
+		r.entries[peer.PublicKey] = entry
+	}
+
+	entry.IP = peerIP(peer)
+	entry.Version = peer.Version
+	entry.LastSeen = now
+
+	if entry.Expires.After(now) {
+		return
+	}
+
+	if length <= 0 {
+		length = r.duration
+	}
+
+	entry.Reason = reason
+	entry.Duration = length
+	entry.Expires = now.Add(length)
+	entry.Bans++
+}
+
+// Entries returns a snapshot of the report ordered by when each peer was first
+// seen
+func (r *Report) Entries() []ReportEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := make([]ReportEntry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].FirstSeen.Equal(entries[j].FirstSeen) {
+			return entries[i].PublicKey < entries[j].PublicKey
+		}
+		return entries[i].FirstSeen.Before(entries[j].FirstSeen)
+	})
+
+	return entries
+}
+
+// Since returns when the report was started
+func (r *Report) Since() time.Time {
+	return r.since
+}
@@ -0,0 +1,66 @@
+package firewall
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gnanderson/xrpl"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func TestReportRecord(t *testing.T) {
+	r := NewReport(10, "10.0.0.20")
+
+	for _, tt := range wlTests {
+		r.Record(&xrpl.Peer{Address: tt.ip + ":1234", PublicKey: tt.ip}, "insane")
+	}
+	// seen again while the ban would still be in place
+	r.Record(&xrpl.Peer{Address: "192.168.1.10:1234", PublicKey: "192.168.1.10"}, "old")
+
+	entries := r.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("unexpected number of report entries '%d'", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.IP.String() != "192.168.1.10" || entry.Reason != "insane" || entry.Bans != 1 {
+		t.Errorf("unexpected report entry: %+v", entry)
+	}
+	if entry.Duration != 10*time.Minute {
+		t.Errorf("unexpected ban duration '%s'", entry.Duration)
+	}
+}
+
+func TestReportRecordAfterExpiry(t *testing.T) {
+	r := NewReport(10)
+	r.duration = time.Second
+
+	peer := &xrpl.Peer{Address: "192.0.2.10:51235", PublicKey: "x"}
+	r.Record(peer, "insane")
+
+	<-time.After(time.Second * 2)
+	r.Record(peer, "old")
+
+	entries := r.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("unexpected number of report entries '%d'", len(entries))
+	}
+	if entries[0].Bans != 2 || entries[0].Reason != "old" {
+		t.Fatalf("expected the peer to be banned again: %+v", entries[0])
+	}
+}
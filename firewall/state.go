@@ -0,0 +1,193 @@
+package firewall
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gnanderson/xrpl"
+)
+
+// stateEntry is a blacklist entry as saved in the state file
+type stateEntry struct {
+	CIDR      string    `json:"cidr"`
+	PublicKey string    `json:"public_key,omitempty"`
+	Expires   time.Time `json:"expires"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// saveState writes the blacklist to the state file, if there is one
+func (fw *Firewall) saveState() {
+	if fw.StateFile == "" {
+		return
+	}
+
+	fw.blacklist.Lock()
+	entries := make([]stateEntry, 0, len(fw.blacklist.entries))
+	for _, entry := range fw.blacklist.entries {
+		ban := fw.blacklist.ban(entry)
+		if ban.IP == nil {
+			continue
+		}
+
+		se := stateEntry{CIDR: ban.CIDR(), Expires: entry.expires, Reason: entry.reason}
+		if entry.network == nil {
+			se.PublicKey = entry.peer.PublicKey
+		}
+		entries = append(entries, se)
+	}
+	fw.blacklist.Unlock()
+
+	if err := writeState(fw.StateFile, entries); err != nil {
+		log.Println(err)
+	}
+}
+
+// write the state file atomically so a crash never leaves it half written
+func writeState(path string, entries []stateEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("firewall: state: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".rbh-state")
+	if err != nil {
+		return fmt.Errorf("firewall: state: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("firewall: state: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("firewall: state: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("firewall: state: %v", err)
+	}
+
+	return nil
+}
+
+// readState returns the entries in the state file by CIDR, a missing file has
+// no entries
+func readState(path string) (map[string]stateEntry, error) {
+	state := make(map[string]stateEntry)
+	if path == "" {
+		return state, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firewall: state: %v", err)
+	}
+
+	var entries []stateEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("firewall: state %s: %v", path, err)
+	}
+
+	for _, entry := range entries {
+		state[entry.CIDR] = entry
+	}
+
+	return state, nil
+}
+
+// Restore rebuilds the blacklist from the bans the backend already has in
+// place, e.g. from before rbh was restarted, so they are covered by
+// RefreshBans and Expire again. The remaining time on each ban comes from the
+// backend if it knows, otherwise from the state file. A ban with no known
+// expiry is given the full ban length from now. Bans the state file shows have
+// expired are lifted. The number of bans restored is returned.
+func (fw *Firewall) Restore() (int, error) {
+	bans, err := fw.Backend.List()
+	if err != nil {
+		return 0, err
+	}
+
+	state, err := readState(fw.StateFile)
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	now := time.Now()
+	for _, ban := range bans {
+		if ban.IP == nil {
+			continue
+		}
+
+		network := ban.Net()
+		key := network.String()
+		expires := ban.Expires
+		reason := ban.Reason
+
+		if saved, ok := state[key]; ok {
+			if saved.PublicKey != "" {
+				key = saved.PublicKey
+			}
+			if expires.IsZero() {
+				expires = saved.Expires
+			}
+			if reason == "" {
+				reason = saved.Reason
+			}
+		}
+
+		if expires.IsZero() {
+			expires = now.Add(fw.blacklist.duration)
+		}
+
+		if !expires.After(now) {
+			if err := fw.Backend.Unban(ban); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+
+		fw.blacklist.Lock()
+		if _, ok := fw.blacklist.entries[key]; !ok {
+			fw.blacklist.entries[key] = &blEntry{
+				peer: &xrpl.Peer{
+					Address:   net.JoinHostPort(network.IP.String(), "0"),
+					PublicKey: key,
+				},
+				expires: expires,
+				reason:  reason,
+				network: network,
+			}
+			restored++
+		}
+		fw.blacklist.Unlock()
+	}
+
+	fw.saveState()
+
+	return restored, nil
+}
@@ -0,0 +1,105 @@
+package firewall
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gnanderson/xrpl"
+)
+
+/*
+Copyright © 2019 Graham Anderson <graham@grahamanderson.scot>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+func TestRestoreFromState(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "bans.json")
+
+	fw, mb := newTestFirewall(10)
+	fw.StateFile = state
+	fw.BanPeer(&xrpl.Peer{Address: banTests[0].addr, PublicKey: "x"})
+	expires := fw.blacklist.entries["x"].expires
+
+	// a backend which can't report the time left, e.g. firewalld rich rules
+	mb.Reset()
+	if err := mb.Ban(&Ban{IP: net.ParseIP(banTests[0].ip)}); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, _ := newTestFirewall(10)
+	restarted.Backend = mb
+	restarted.StateFile = state
+
+	restored, err := restarted.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 1 {
+		t.Fatalf("unexpected number of bans restored '%d'", restored)
+	}
+
+	entry, ok := restarted.blacklist.entries["x"]
+	if !ok {
+		t.Fatal("expected the entry to be restored by public key")
+	}
+	if !entry.expires.Equal(expires) {
+		t.Fatalf("expected expiry %s, got %s", expires, entry.expires)
+	}
+
+	mb.Reset()
+	restarted.RefreshBans()
+	rules := mb.Rules()
+	if len(rules) != 1 || rules[0].Ban.CIDR() != banTests[0].ip+"/32" {
+		t.Fatalf("restored ban was not refreshed: %+v", rules)
+	}
+}
+
+func TestRestoreWithoutState(t *testing.T) {
+	fw, mb := newTestFirewall(10)
+
+	bans := []*Ban{
+		{IP: net.ParseIP("192.0.2.0"), Prefix: 24},
+		NewBan(net.ParseIP("2001:db8::10"), time.Minute),
+	}
+	for _, ban := range bans {
+		if err := mb.Ban(ban); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restored, err := fw.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 2 {
+		t.Fatalf("unexpected number of bans restored '%d'", restored)
+	}
+
+	for _, ban := range fw.blacklist.bans() {
+		switch ban.CIDR() {
+		case "192.0.2.0/24":
+			if ban.Timeout() < 9*time.Minute {
+				t.Errorf("expected the full ban length for %s, got %s", ban.CIDR(), ban.Timeout())
+			}
+		case "2001:db8::10/128":
+			if ban.Timeout() > time.Minute {
+				t.Errorf("expected the backend timeout for %s, got %s", ban.CIDR(), ban.Timeout())
+			}
+		default:
+			t.Errorf("unexpected ban restored %s", ban)
+		}
+	}
+}